@@ -0,0 +1,136 @@
+package scp_test
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/glutwins/scp"
+	"github.com/glutwins/scp/scptest"
+)
+
+// benchHelper helper connected to a StartServer rooted in a temp dir, with
+// rtt of latency added to the link
+func benchHelper(b *testing.B, rtt time.Duration) scp.Helper {
+	root, err := ioutil.TempDir("", "scp-bench-")
+	if err != nil {
+		b.Fatal(err)
+	}
+	addr, cleanup, err := scptest.StartServer(root)
+	if err != nil {
+		os.RemoveAll(root)
+		b.Fatal(err)
+	}
+	dialer := scptest.Dialer(addr)
+	if rtt > 0 {
+		dialer.DialFunc = func(network, addr string) (net.Conn, error) {
+			conn, err := net.Dial(network, addr)
+			if err != nil {
+				return nil, err
+			}
+			return newLatencyConn(conn, rtt), nil
+		}
+	}
+	h := scp.NewHelper(&dialer)
+	b.Cleanup(func() {
+		h.Close()
+		cleanup()
+		os.RemoveAll(root)
+	})
+	return h
+}
+
+// latencyConn deliver what the remote sent delay after it arrived, without
+// slowing the writes, so a whole round trip cost delay
+type latencyConn struct {
+	net.Conn
+	delay  time.Duration
+	chunks chan latencyChunk
+	rest   []byte
+	err    error
+}
+
+type latencyChunk struct {
+	at   time.Time
+	data []byte
+	err  error
+}
+
+func newLatencyConn(conn net.Conn, delay time.Duration) *latencyConn {
+	c := &latencyConn{Conn: conn, delay: delay, chunks: make(chan latencyChunk, 1024)}
+	go func() {
+		for {
+			buf := make([]byte, 32<<10)
+			n, err := conn.Read(buf)
+			c.chunks <- latencyChunk{at: time.Now().Add(delay), data: buf[:n], err: err}
+			if err != nil {
+				close(c.chunks)
+				return
+			}
+		}
+	}()
+	return c
+}
+
+func (c *latencyConn) Read(p []byte) (int, error) {
+	for len(c.rest) == 0 {
+		if c.err != nil {
+			return 0, c.err
+		}
+		chunk, ok := <-c.chunks
+		if !ok {
+			return 0, io.EOF
+		}
+		time.Sleep(time.Until(chunk.at))
+		c.rest, c.err = chunk.data, chunk.err
+	}
+	n := copy(p, c.rest)
+	c.rest = c.rest[n:]
+	return n, nil
+}
+
+// BenchmarkCopyBufferSize upload over localhost and over a 100ms round trip
+// link. On the slow link the ssh channel window bound the throughput, the
+// copy buffer size make no difference.
+func BenchmarkCopyBufferSize(b *testing.B) {
+	data := bytes.Repeat([]byte("0123456789abcdef"), 8<<20/16)
+	for _, bench := range []struct {
+		rtt  time.Duration
+		size int
+	}{
+		{0, 0}, {0, 128 << 10}, {0, 1 << 20},
+		{100 * time.Millisecond, 0}, {100 * time.Millisecond, 128 << 10}, {100 * time.Millisecond, 1 << 20},
+	} {
+		size := bench.size
+		b.Run(fmt.Sprintf("rtt=%s/buffer=%d", bench.rtt, size), func(b *testing.B) {
+			h := benchHelper(b, bench.rtt)
+			h.SetBufferSize(size)
+			b.SetBytes(int64(len(data)))
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if err := h.CopyBytes(data, "/big.bin"); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkCopySmallFiles(b *testing.B) {
+	h := benchHelper(b, 0)
+	data := bytes.Repeat([]byte("x"), 1024)
+	b.SetBytes(int64(len(data)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := h.CopyBytes(data, fmt.Sprintf("/small-%d", i%100)); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,34 @@
+package scp
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"testing"
+)
+
+// BenchmarkCopyBuffer body copy of a small file through the pooled buffer,
+// against a buffer allocated per copy as before the pool
+func BenchmarkCopyBuffer(b *testing.B) {
+	data := bytes.Repeat([]byte("x"), 1024)
+	// neither side short-cut the buffer, as the LimitReader and the session
+	// channel of a transfer
+	dst := struct{ io.Writer }{ioutil.Discard}
+	src := func() io.Reader { return io.LimitReader(bytes.NewReader(data), int64(len(data))) }
+	b.Run("pooled", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if _, err := copyBuffer(dst, src(), 0); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("unpooled", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if _, err := io.CopyBuffer(dst, src(), make([]byte, defaultBufferSize)); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
@@ -0,0 +1,106 @@
+package scp
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Compression algorithm applied to contents before upload
+type Compression int
+
+const (
+	// None send contents as is
+	None Compression = iota
+	// Gzip compress with gzip, remote file get a ".gz" suffix
+	Gzip
+	// Zstd compress with zstandard, remote file get a ".zst" suffix
+	Zstd
+)
+
+func (c Compression) String() string {
+	switch c {
+	case None:
+		return "none"
+	case Gzip:
+		return "gzip"
+	case Zstd:
+		return "zstd"
+	}
+	return fmt.Sprintf("Compression(%d)", int(c))
+}
+
+// suffix appended to the remote file name
+func (c Compression) suffix() string {
+	switch c {
+	case Gzip:
+		return ".gz"
+	case Zstd:
+		return ".zst"
+	}
+	return ""
+}
+
+// decompressCmd remote command decompressing stdin to stdout
+func (c Compression) decompressCmd() string {
+	switch c {
+	case Gzip:
+		return "gzip -dc"
+	case Zstd:
+		return "zstd -dcq"
+	}
+	return "cat"
+}
+
+// checkLevel validate level for c, 0 always mean the algorithm default
+func (c Compression) checkLevel(level int) error {
+	switch c {
+	case None:
+		return nil
+	case Gzip:
+		if level == 0 || (level >= gzip.HuffmanOnly && level <= gzip.BestCompression) {
+			return nil
+		}
+		return fmt.Errorf("gzip level %d out of range [%d, %d]", level, gzip.HuffmanOnly, gzip.BestCompression)
+	case Zstd:
+		if level >= 0 && level <= 22 {
+			return nil
+		}
+		return fmt.Errorf("zstd level %d out of range [1, 22]", level)
+	}
+	return fmt.Errorf("unknown compression %s", c)
+}
+
+// newWriter wrap w with the compressor of c at level
+func (c Compression) newWriter(w io.Writer, level int) (io.WriteCloser, error) {
+	switch c {
+	case Gzip:
+		if level == 0 {
+			level = gzip.DefaultCompression
+		}
+		return gzip.NewWriterLevel(w, level)
+	case Zstd:
+		if level == 0 {
+			return zstd.NewWriter(w)
+		}
+		return zstd.NewWriter(w, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(level)))
+	}
+	return nil, fmt.Errorf("unknown compression %s", c)
+}
+
+// newReader wrap r with the decompressor of c
+func (c Compression) newReader(r io.Reader) (io.ReadCloser, error) {
+	switch c {
+	case Gzip:
+		return gzip.NewReader(r)
+	case Zstd:
+		d, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return d.IOReadCloser(), nil
+	}
+	return nil, fmt.Errorf("unknown compression %s", c)
+}
@@ -0,0 +1,43 @@
+package scp
+
+import (
+	"net"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// ConnectionInfo how an ssh connection was established, for auditing
+type ConnectionInfo struct {
+	User          string
+	ClientVersion string
+	ServerVersion string
+	RemoteAddr    net.Addr
+	SessionID     []byte
+	// Algorithms negotiated kex, host key, cipher and mac, Read is
+	// server to client and Write client to server. Left empty when the
+	// x/crypto version in use does not expose them.
+	Algorithms ssh.NegotiatedAlgorithms
+}
+
+// Connect like Dial, also returning how the connection was secured
+func (d Dialer) Connect() (*ssh.Client, ConnectionInfo, error) {
+	client, err := d.Dial()
+	if err != nil {
+		return nil, ConnectionInfo{}, err
+	}
+	return client, connectionInfo(client.Conn), nil
+}
+
+func connectionInfo(conn ssh.ConnMetadata) ConnectionInfo {
+	info := ConnectionInfo{
+		User:          conn.User(),
+		ClientVersion: string(conn.ClientVersion()),
+		ServerVersion: string(conn.ServerVersion()),
+		RemoteAddr:    conn.RemoteAddr(),
+		SessionID:     conn.SessionID(),
+	}
+	if algo, ok := conn.(ssh.AlgorithmsConnMetadata); ok {
+		info.Algorithms = algo.Algorithms()
+	}
+	return info
+}
@@ -0,0 +1,70 @@
+package scp
+
+import (
+	"context"
+	"errors"
+	"os"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// DeployOptions describe a Deploy, zero fields disable their step
+type DeployOptions struct {
+	// Dialer connect to the target, unless Client is set
+	Dialer *Dialer
+	// Client reuse a connection owned by the caller, left open
+	Client *ssh.Client
+	// Context bound the whole deploy, default context.Background()
+	Context context.Context
+	// Logger receive the logs of every step
+	Logger Logger
+
+	// Source local file uploaded as Target
+	Source string
+	Target string
+
+	// MkdirParents create the parent directories of Target, see SetMkdirParents
+	MkdirParents bool
+	// Verify compare the remote sha256 with the bytes sent, see SetVerifyChecksum
+	Verify bool
+	// Mode chmod Target before it is renamed into place, see SetRemoteChmod
+	Mode os.FileMode
+	// Owner and Group chown Target before it is renamed into place, see SetRemoteChown
+	Owner string
+	Group string
+	// Restart command run once Target is in place, e.g. "systemctl restart app"
+	Restart string
+}
+
+// Deploy upload Source to a temp path beside Target over a single
+// connection, then verify, chmod and chown it, rename it into place and run
+// Restart. Target is left untouched when any step before the rename fail.
+func Deploy(opts DeployOptions) error {
+	var s *scpHelperDelegate
+	switch {
+	case opts.Client != nil:
+		s = NewHelperFromClient(opts.Client).(*scpHelperDelegate)
+	case opts.Dialer != nil:
+		s = newHelperDelegate(opts.Dialer)
+	default:
+		return errors.New("deploy need a Dialer or a Client")
+	}
+	defer s.Close()
+
+	ctx := opts.Context
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	if opts.Logger != nil {
+		s.SetLogger(opts.Logger)
+	}
+	s.SetAtomic(true)
+	s.SetMkdirParents(opts.MkdirParents)
+	s.SetVerifyChecksum(opts.Verify)
+	s.SetRemoteChmod(opts.Mode)
+	s.SetRemoteChown(opts.Owner, opts.Group)
+	s.SetPostCommand(opts.Restart)
+
+	s.logger.Infof("deploy %s to %s", opts.Source, opts.Target)
+	return s.CopyPathContext(ctx, opts.Source, opts.Target)
+}
@@ -0,0 +1,91 @@
+package scp
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestClientConfigAuthMethods(t *testing.T) {
+	answer := func(string, string, []string, []bool) ([]string, error) { return nil, nil }
+	tests := []struct {
+		name   string
+		dialer Dialer
+		want   int
+	}{
+		{"password", Dialer{SSHPass: "secret"}, 1},
+		{"no empty password", Dialer{}, 0},
+		{"keyboard interactive alone", Dialer{KeyboardInteractiveFunc: ssh.KeyboardInteractiveChallenge(answer)}, 1},
+		{"password callback", Dialer{SSHPassCallback: func() (string, error) { return "secret", nil }}, 1},
+	}
+	for _, tt := range tests {
+		tt.dialer.InsecureIgnoreHostKey = true
+		config, release, err := tt.dialer.clientConfig()
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		release()
+		if len(config.Auth) != tt.want {
+			t.Errorf("%s: got %d auth methods, want %d", tt.name, len(config.Auth), tt.want)
+		}
+	}
+}
+
+func TestNormalizeAddr(t *testing.T) {
+	tests := []struct {
+		addr string
+		want string
+		ok   bool
+	}{
+		{"example.com", "example.com:22", true},
+		{"example.com:2222", "example.com:2222", true},
+		{"10.0.0.1", "10.0.0.1:22", true},
+		{"::1", "[::1]:22", true},
+		{"[::1]", "[::1]:22", true},
+		{"[::1]:2222", "[::1]:2222", true},
+		{"fe80::1%eth0", "[fe80::1%eth0]:22", true},
+		{"", "", false},
+		{":22", "", false},
+		{"example.com:0", "", false},
+		{"example.com:65536", "", false},
+		{"example.com:ssh", "", false},
+		{"host:with:colons", "", false},
+	}
+	for _, tt := range tests {
+		got, err := normalizeAddr(tt.addr)
+		if tt.ok && (err != nil || got != tt.want) {
+			t.Errorf("%q: got %q %v, want %q", tt.addr, got, err, tt.want)
+		}
+		var bad ErrBadAddress
+		if !tt.ok && !errors.As(err, &bad) {
+			t.Errorf("%q: got %q %v, want ErrBadAddress", tt.addr, got, err)
+		}
+	}
+}
+
+func TestCheckClientVersion(t *testing.T) {
+	tests := []struct {
+		version string
+		ok      bool
+	}{
+		{"", true},
+		{"SSH-2.0-deploy_1.0", true},
+		{"SSH-2.0-" + strings.Repeat("x", maxClientVersion-8), true},
+		{"SSH-2.0-" + strings.Repeat("x", maxClientVersion-7), false},
+		{"SSH-1.99-old", false},
+		{"deploy", false},
+		{"SSH-2.0-bad\r\nline", false},
+		{"SSH-2.0-café", false},
+	}
+	for _, tt := range tests {
+		err := Dialer{ClientVersion: tt.version}.checkClientVersion()
+		var bad ErrClientVersion
+		if tt.ok && err != nil {
+			t.Errorf("%q: %v", tt.version, err)
+		} else if !tt.ok && !errors.As(err, &bad) {
+			t.Errorf("%q: got %v, want ErrClientVersion", tt.version, err)
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package scp
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+)
+
+// dryRunSink log the records a transfer would send, without any session
+type dryRunSink struct {
+	logger   Logger
+	progress func(copied, total int64)
+	total    *int64
+	dirs     []string
+}
+
+func (s *scpHelperDelegate) dryRunSink(dstdir string) *dryRunSink {
+	return &dryRunSink{logger: s.logger, progress: s.progress, total: &s.dryRunBytes, dirs: []string{dstdir}}
+}
+
+func (d *dryRunSink) path(name string) string {
+	return filepath.Join(append(d.dirs, name)...)
+}
+
+func (d *dryRunSink) times(t *fileTimes) error {
+	d.logger.Infof("dry-run: T%d 0 %d 0", t.mtime.Unix(), t.atime.Unix())
+	return nil
+}
+
+func (d *dryRunSink) dir(mode os.FileMode, name string) error {
+	d.logger.Infof("dry-run: D%04o 0 %s", mode.Perm(), d.path(name))
+	d.dirs = append(d.dirs, name)
+	return nil
+}
+
+func (d *dryRunSink) file(mode os.FileMode, size int64, name string, r io.Reader) error {
+	d.logger.Infof("dry-run: C%04o %d %s", mode.Perm(), size, d.path(name))
+	atomic.AddInt64(d.total, size)
+	if d.progress != nil {
+		d.progress(size, size)
+	}
+	return nil
+}
+
+func (d *dryRunSink) end() error {
+	if len(d.dirs) > 1 {
+		d.dirs = d.dirs[:len(d.dirs)-1]
+	}
+	return nil
+}
+
+func (d *dryRunSink) wait() error  { return nil }
+func (d *dryRunSink) close() error { return nil }
+
+// dryRunCopy report the single file copyTo would send as path/name
+func (s *scpHelperDelegate) dryRunCopy(r io.Reader, size int64, path, name string, mode os.FileMode, times *fileTimes) error {
+	if s.mode != 0 {
+		mode = s.mode
+	} else if mode == 0 {
+		mode = os.ModePerm
+	}
+
+	if s.compressing(size) {
+		cb, plain, release, err := s.compress(r, nil)
+		if err != nil {
+			return err
+		}
+		defer release()
+		if plain == nil {
+			name = s.compressedName(name)
+			size = int64(cb.Len())
+		}
+	}
+
+	snk := s.dryRunSink(path)
+	if times != nil {
+		snk.times(times)
+	}
+	return snk.file(mode, size, name, r)
+}
@@ -2,17 +2,29 @@ package scp
 
 import (
 	"bytes"
-	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"hash"
 	"io"
 	"io/ioutil"
+	"math/rand"
 	"net"
 	"os"
 	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
 )
 
 // ErrTimes error descibe scp fail
@@ -25,17 +37,421 @@ func (err ErrTimes) Error() string {
 	return fmt.Sprintf("copy fail after try %d times: %s", err.times, err.err.Error())
 }
 
+// Unwrap the error of the last attempt
+func (err ErrTimes) Unwrap() error {
+	return err.err
+}
+
+// Times number of attempts made
+func (err ErrTimes) Times() int {
+	return err.times
+}
+
+// ErrFile error bound to the local file that caused it
+type ErrFile struct {
+	Path string
+	Err  error
+}
+
+func (err ErrFile) Error() string {
+	return err.Path + ": " + err.Err.Error()
+}
+
+func (err ErrFile) Unwrap() error {
+	return err.Err
+}
+
+// ErrFiles errors collected while copying many files
+type ErrFiles []*ErrFile
+
+func (errs ErrFiles) Error() string {
+	msgs := make([]string, len(errs))
+	for i, err := range errs {
+		msgs[i] = err.Error()
+	}
+	return fmt.Sprintf("copy fail for %d files: %s", len(errs), strings.Join(msgs, "; "))
+}
+
+// HostKeyMismatchError host key presented by server differ from the known_hosts entry
+type HostKeyMismatchError struct {
+	Hostname string
+	Key      ssh.PublicKey
+	Err      *knownhosts.KeyError
+}
+
+func (err HostKeyMismatchError) Error() string {
+	return fmt.Sprintf("host key mismatch for %s: %s", err.Hostname, err.Err.Error())
+}
+
+// ErrDialTimeout connecting Addr did not complete within Timeout
+type ErrDialTimeout struct {
+	Addr    string
+	Timeout time.Duration
+	Err     error
+}
+
+func (err ErrDialTimeout) Error() string {
+	return fmt.Sprintf("dial %s timeout after %s: %s", err.Addr, err.Timeout, err.Err.Error())
+}
+
+func (err ErrDialTimeout) Unwrap() error {
+	return err.Err
+}
+
+// ErrKeyRead the private key file at Path could not be read
+type ErrKeyRead struct {
+	Path string
+	Err  error
+}
+
+func (err ErrKeyRead) Error() string {
+	return fmt.Sprintf("read private key %s: %s", err.Path, err.Err.Error())
+}
+
+func (err ErrKeyRead) Unwrap() error {
+	return err.Err
+}
+
+// ErrKeyParse the private key at Path is not a valid, decryptable private key
+type ErrKeyParse struct {
+	Path string
+	Err  error
+}
+
+func (err ErrKeyParse) Error() string {
+	return fmt.Sprintf("parse private key %s: %s", err.Path, err.Err.Error())
+}
+
+func (err ErrKeyParse) Unwrap() error {
+	return err.Err
+}
+
+// ErrCertificate SSHCertFile can not be used to authenticate
+type ErrCertificate struct {
+	Path   string
+	Reason string
+}
+
+func (err ErrCertificate) Error() string {
+	return fmt.Sprintf("certificate %s: %s", err.Path, err.Reason)
+}
+
+// ErrUnsupportedAlgorithm Name set in Dialer Ciphers, MACs or KeyExchanges is unknown to x/crypto/ssh
+type ErrUnsupportedAlgorithm struct {
+	Kind      string
+	Name      string
+	Supported []string
+}
+
+func (err ErrUnsupportedAlgorithm) Error() string {
+	return fmt.Sprintf("unsupported %s %q, valid values: %s", err.Kind, err.Name, strings.Join(err.Supported, ", "))
+}
+
+// ErrBadAddress Dialer SSHAddr is not a valid host:port
+type ErrBadAddress struct {
+	Addr   string
+	Reason string
+}
+
+func (err ErrBadAddress) Error() string {
+	return fmt.Sprintf("bad ssh address %q: %s", err.Addr, err.Reason)
+}
+
+// ErrClientVersion Dialer ClientVersion is not a valid SSH-2.0 identification
+type ErrClientVersion struct {
+	Version string
+	Reason  string
+}
+
+func (err ErrClientVersion) Error() string {
+	return fmt.Sprintf("bad client version %q: %s", err.Version, err.Reason)
+}
+
+// ErrFileTooLarge a file of Size bytes exceed the SetMaxFileSize Limit
+type ErrFileTooLarge struct {
+	Size  int64
+	Limit int64
+}
+
+func (err ErrFileTooLarge) Error() string {
+	return fmt.Sprintf("file of %d bytes exceed the max file size %d", err.Size, err.Limit)
+}
+
+// ErrInsufficientSpace the filesystem of Dir has Avail bytes, less than the
+// Need of the upload plus its margin
+type ErrInsufficientSpace struct {
+	Dir   string
+	Need  int64
+	Avail int64
+}
+
+func (err ErrInsufficientSpace) Error() string {
+	return fmt.Sprintf("not enough space in %s: need %d bytes, %d available", err.Dir, err.Need, err.Avail)
+}
+
+// ErrAuth the server at Addr rejected every authentication method tried for User
+type ErrAuth struct {
+	User string
+	Addr string
+	Err  error
+}
+
+func (err ErrAuth) Error() string {
+	return fmt.Sprintf("authenticate %s@%s: %s", err.User, err.Addr, err.Err.Error())
+}
+
+func (err ErrAuth) Unwrap() error {
+	return err.Err
+}
+
+// ErrSetenv the remote rejected the Name variable of SetEnv in strict mode,
+// usually sshd AcceptEnv do not list it
+type ErrSetenv struct {
+	Name string
+	Err  error
+}
+
+func (err ErrSetenv) Error() string {
+	return fmt.Sprintf("setenv %s rejected by remote, check sshd AcceptEnv: %s", err.Name, err.Err.Error())
+}
+
+func (err ErrSetenv) Unwrap() error {
+	return err.Err
+}
+
+// ErrDialAttempts DialRetryContext gave up on Addr after Attempts, Err is the last failure
+type ErrDialAttempts struct {
+	Addr     string
+	Attempts int
+	Err      error
+}
+
+func (err ErrDialAttempts) Error() string {
+	return fmt.Sprintf("dial %s fail after %d attempts: %s", err.Addr, err.Attempts, err.Err.Error())
+}
+
+func (err ErrDialAttempts) Unwrap() error {
+	return err.Err
+}
+
+// TimeoutError a transfer, retries included, did not finish within the
+// SetTransferTimeout duration
+type TimeoutError struct {
+	Timeout time.Duration
+}
+
+func (err TimeoutError) Error() string {
+	return fmt.Sprintf("transfer timeout after %s", err.Timeout)
+}
+
+func (err TimeoutError) Unwrap() error {
+	return context.DeadlineExceeded
+}
+
+// ErrCommand the pre or post command Cmd failed, Err is usually a RemoteError
+// holding its exit status and output
+type ErrCommand struct {
+	Cmd string
+	Err error
+}
+
+func (err ErrCommand) Error() string {
+	return fmt.Sprintf("run %q: %s", err.Cmd, err.Err.Error())
+}
+
+func (err ErrCommand) Unwrap() error {
+	return err.Err
+}
+
+// ErrSkippedIdentical copy skipped since the remote file hold the same content
+var ErrSkippedIdentical = errors.New("remote file identical, copy skipped")
+
+// ChecksumMismatchError remote file sum differ from the sum of bytes sent
+type ChecksumMismatchError struct {
+	Local  string
+	Remote string
+}
+
+func (err ChecksumMismatchError) Error() string {
+	return fmt.Sprintf("checksum mismatch: local %s, remote %s", err.Local, err.Remote)
+}
+
+// ErrPermanent error that retrying can not fix, MustCopy and TryCopy stop at it
+type ErrPermanent struct {
+	Err error
+}
+
+func (err ErrPermanent) Error() string {
+	return "copy fail permanently: " + err.Err.Error()
+}
+
+func (err ErrPermanent) Unwrap() error {
+	return err.Err
+}
+
+// RetryableError report whether err may go away on retry, such as network
+// failures and timeouts. Authentication, host key, permission, missing file
+// and remote commands that exited with a status, e.g. 127 when scp is not
+// installed, are permanent.
+func RetryableError(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	var (
+		nerr     net.Error
+		ack      *ErrAck
+		mismatch *HostKeyMismatchError
+		keyErr   *knownhosts.KeyError
+		perm     *ErrPermanent
+		cert     ErrCertificate
+		algo     ErrUnsupportedAlgorithm
+		keyRead  ErrKeyRead
+		keyParse ErrKeyParse
+		sizeErr  SizeMismatchError
+		cmdErr   ErrCommand
+		addrErr  ErrBadAddress
+		tooLarge ErrFileTooLarge
+		noSpace  ErrInsufficientSpace
+		version  ErrClientVersion
+		auth     ErrAuth
+		remote   *RemoteError
+		setenv   ErrSetenv
+	)
+	switch {
+	case errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+		return false
+	case errors.As(err, &nerr):
+		return true
+	case errors.As(err, &perm), errors.As(err, &ack), errors.As(err, &mismatch), errors.As(err, &keyErr),
+		errors.As(err, &cert), errors.As(err, &algo), errors.As(err, &keyRead), errors.As(err, &keyParse),
+		errors.As(err, &sizeErr), errors.As(err, &cmdErr), errors.As(err, &addrErr),
+		errors.As(err, &tooLarge), errors.As(err, &noSpace), errors.As(err, &version),
+		errors.As(err, &auth), errors.As(err, &remote), errors.As(err, &setenv):
+		return false
+	case errors.Is(err, os.ErrNotExist), errors.Is(err, os.ErrPermission):
+		return false
+	}
+	return true
+}
+
+// BackoffFunc return the delay before retry attempt, attempt start at 1
+type BackoffFunc func(attempt int) time.Duration
+
+// jitter spread d over [d/2, d), so a fleet failing together do not retry in sync
+func jitter(d time.Duration) time.Duration {
+	return time.Duration(float64(d) * (0.5 + rand.Float64()*0.5))
+}
+
+// DefaultBackoff wait attempt seconds, and one minute after ten attempts
+func DefaultBackoff(attempt int) time.Duration {
+	if attempt > 10 {
+		return time.Minute
+	}
+	return time.Duration(attempt) * time.Second
+}
+
+// ErrPartial a multi-file transfer aborted at Failed, after copying Sent
+type ErrPartial struct {
+	Sent   []string
+	Failed *ErrFile
+}
+
+func (err ErrPartial) Error() string {
+	return fmt.Sprintf("copy abort after %d files: %s", len(err.Sent), err.Failed.Error())
+}
+
+func (err ErrPartial) Unwrap() error {
+	return err.Failed
+}
+
 // Helper helper for scp utility
 type Helper interface {
 	Copy(io.Reader, int64, string) error
 	CopyPath(string, string) error
+	CopyContext(context.Context, io.Reader, int64, string) error
+	CopyPathContext(context.Context, string, string) error
+	CopyWithTimes(io.Reader, int64, string, time.Time, time.Time) error
+	CopyBytes([]byte, string) error
+	CopyString(string, string) error
+	CopyStream(string) (io.WriteCloser, error)
+	CopyTo(io.Reader, int64, string, string) error
+	CopyAuto(io.Reader, string) error
+	CopyMulti(io.ReaderAt, int64, []string) error
 	MustCopy(io.Reader, int64, string)
 	MustCopyPath(string, string)
 	TryCopy(io.Reader, int64, string, int) error
 	TryCopyPath(string, string, int) error
+	CopyDir(string, string) error
+	CopyFiles([]string, string) error
+	CopyGlob(string, string) error
+	Fetch(string, io.Writer) (int64, error)
+	Stat(string) (os.FileInfo, error)
+	FetchPath(string, string) error
+
+	Close() error
 
+	// Deprecated: use SetLimitKbps or SetLimitKBps
 	SetLimitKB(int)
+	SetLimitKbps(int) error
+	SetLimitKBps(int) error
 	SetGzipEnable(bool)
+	SetCompression(Compression, int) error
+	SetFollowSymlinks(bool)
+	SetContinueOnError(bool)
+	SetPreserveTimes(bool)
+	SetProgressFunc(func(copied, total int64))
+	SetBackoff(BackoffFunc)
+	SetMaxRetryDuration(time.Duration)
+	SetEnv(map[string]string)
+	SetSkipIfIdentical(bool)
+	SetVerifyChecksum(bool)
+	SetChecksumCommand(string)
+	SetMode(os.FileMode)
+	SetAtomic(bool)
+	SetLogger(Logger)
+	SetMetrics(Metrics)
+	SetResume(bool)
+	SetRateLimiter(*RateLimiter)
+	SetKeepAlive(time.Duration)
+	SetDryRun(bool)
+	DryRunBytes() int64
+	SetMkdirParents(bool)
+	SetMkdirMode(os.FileMode)
+	SetGzipSuffix(string)
+	SetGzipTransparent(bool)
+	SetBufferSize(int)
+	SetTransferTimeout(time.Duration)
+	SetRemoteChmod(os.FileMode)
+	SetRemoteChown(string, string)
+	SetPreCommand(string)
+	SetPostCommand(string)
+	SetGzipMinRatio(float64)
+	RemoteVersion() (string, error)
+	SetHash(hash.Hash)
+	Sum() []byte
+	SetJitter(bool)
+	CopyPathAs(string, string, string) error
+	CopyAndVerify(io.ReaderAt, int64, string) error
+	SetWireLog(io.Writer)
+	SetGzipMinSize(int64)
+	SetEnvStrict(bool)
+	CopyReaderAt(io.ReaderAt, int64, string) error
+	TryCopyReaderAt(io.ReaderAt, int64, string, int) error
+	CopyDirParallel(string, string, int) error
+	SetMaxFileSize(int64)
+	SetCheckDiskSpace(bool)
+	SetDiskSpaceMargin(int64)
+	Ping() error
+	SetTempDir(string)
+	SetTempPrefix(string)
+	SetRemoteTempDir(string)
+	SetAppend(bool)
+	SetLocalLimit(int)
+	SetOnReconnect(func(error))
+	VerifyBinarySafe([]byte, string) error
+	CopyPathWithReader(string, func(io.Reader) io.Reader, string) error
+	CopyTar(map[string]io.Reader, map[string]int64, string) error
 }
 
 // Dialer ssh config
@@ -44,184 +460,2472 @@ type Dialer struct {
 	SSHFile string
 	SSHPass string
 	SSHAddr string
-}
 
-// Dial connect and auth ssh client
-func (d Dialer) Dial() (*ssh.Client, error) {
-	var authm ssh.AuthMethod
-	if d.SSHFile != "" {
-		b, err := ioutil.ReadFile(d.SSHFile)
-		if err != nil {
-			return nil, err
-		}
+	// SSHPassCallback fetch the password at handshake time, e.g. from a
+	// secret manager, used instead of SSHPass when set
+	SSHPassCallback func() (string, error)
+	// SSHKeyBytes PEM private key kept in memory, used instead of SSHFile
+	SSHKeyBytes []byte
+	// SSHPassphrase decrypt SSHKeyBytes or SSHFile when it is encrypted
+	SSHPassphrase string
+	// SSHCertFile user certificate signed by a CA for the private key,
+	// e.g. id_ed25519-cert.pub
+	SSHCertFile string
+	// SSHUseAgent try keys served by the ssh-agent at SSH_AUTH_SOCK first,
+	// then SSHFile, then SSHPass, the server accept whichever it support
+	SSHUseAgent bool
+	// KeyboardInteractiveFunc answer keyboard-interactive prompts, e.g. an
+	// OTP asked by an MFA gateway, tried after the key or password
+	KeyboardInteractiveFunc ssh.KeyboardInteractiveChallenge
 
-		key, err := ssh.ParsePrivateKey(b)
-		if err != nil {
-			return nil, err
-		}
+	// KnownHostsFile verify host key against it, default ~/.ssh/known_hosts
+	KnownHostsFile string
+	// InsecureIgnoreHostKey accept any host key when KnownHostsFile is unset
+	InsecureIgnoreHostKey bool
+	// HostKeyCallback verify the host key with custom logic, it take
+	// precedence over KnownHostsFile and InsecureIgnoreHostKey
+	HostKeyCallback ssh.HostKeyCallback
+	// HostKeyAlgorithms accepted host key types in order of preference,
+	// e.g. []string{ssh.KeyAlgoED25519}, default let the ssh package choose
+	HostKeyAlgorithms []string
 
-		authm = ssh.PublicKeys(key)
-	} else {
-		authm = ssh.Password(d.SSHPass)
-	}
+	// Ciphers, MACs and KeyExchanges restrict the algorithms offered, in
+	// order of preference, default let the ssh package choose. Insecure
+	// algorithms known by x/crypto/ssh are accepted for legacy servers.
+	Ciphers      []string
+	MACs         []string
+	KeyExchanges []string
 
-	return ssh.Dial("tcp", d.SSHAddr, &ssh.ClientConfig{
-		Auth: []ssh.AuthMethod{authm},
-		User: d.SSHUser,
-		HostKeyCallback: func(hostname string, remote net.Addr, key ssh.PublicKey) error {
-			return nil
-		},
-	})
-}
+	// DialTimeout bound tcp connect and handshake, default 30s
+	DialTimeout time.Duration
+	// DialBackoff delay between attempts of DialRetryContext, default DefaultBackoff
+	DialBackoff BackoffFunc
 
-type scpHelperDelegate struct {
-	dialer *Dialer
-	client *ssh.Client
-	lock   sync.RWMutex
-	flags  string
-	gzip   bool
+	// Jump bastion hosts to go through in order, like ssh ProxyJump
+	Jump []Dialer
+	// DialFunc open the transport instead of a tcp dial, e.g. a websocket
+	// tunnel or a net.Pipe in tests, SSHAddr is then passed as is. With Jump
+	// it carry the first hop, unless that hop set its own.
+	DialFunc func(network, addr string) (net.Conn, error)
+	// ClientVersion identification sent to the server, e.g. "SSH-2.0-myapp_1.0",
+	// default the x/crypto/ssh one
+	ClientVersion string
+	// ConfigureClient edit the client config once built from the fields
+	// above, e.g. to set BannerCallback or RekeyThreshold, its changes win.
+	// A zero Timeout disable the dial and handshake timeout.
+	ConfigureClient func(*ssh.ClientConfig)
 }
 
-// NewHelper New Scp Helper
-func NewHelper(dialer *Dialer) Helper {
-	return &scpHelperDelegate{dialer: dialer}
+const defaultDialTimeout = 30 * time.Second
+
+// Dial connect and auth ssh client
+func (d Dialer) Dial() (*ssh.Client, error) {
+	return d.DialContext(context.Background())
 }
 
-func (s *scpHelperDelegate) newSession() (*ssh.Session, error) {
-	s.lock.Lock()
-	defer s.lock.Unlock()
-	var err error
-	if s.client == nil {
-		if s.client, err = s.dialer.Dial(); err != nil {
+// DialContext connect and auth ssh client, abort when ctx is done
+func (d Dialer) DialContext(ctx context.Context) (*ssh.Client, error) {
+	if d.DialFunc == nil {
+		addr, err := normalizeAddr(d.SSHAddr)
+		if err != nil {
 			return nil, err
 		}
+		d.SSHAddr = addr
 	}
 
-	if sess, err := s.client.NewSession(); err != nil {
-		s.client.Close()
-		s.client = nil
-	} else {
-		return sess, nil
+	config, release, err := d.clientConfig()
+	if err != nil {
+		return nil, err
 	}
+	defer release()
 
-	if s.client, err = s.dialer.Dial(); err != nil {
+	bastion, conn, err := d.dialConn(ctx, config.Timeout)
+	if err != nil {
 		return nil, err
 	}
 
-	return s.client.NewSession()
-}
-
-func (s *scpHelperDelegate) Copy(r io.Reader, size int64, dstfile string) error {
-	session, err := s.newSession()
+	stop := watchContext(ctx, conn)
+	// ConfigureClient may clear Timeout, which mean no timeout
+	if config.Timeout > 0 {
+		conn.SetDeadline(time.Now().Add(config.Timeout))
+	}
+	c, chans, reqs, err := ssh.NewClientConn(conn, d.SSHAddr, config)
+	if stop() {
+		err = ctx.Err()
+	} else if err != nil {
+		err = d.authError(d.timeoutError(err, config.Timeout))
+	}
 	if err != nil {
-		return err
+		conn.Close()
+		if bastion != nil {
+			bastion.Close()
+		}
+		return nil, err
 	}
+	conn.SetDeadline(time.Time{})
 
-	defer session.Close()
-
-	name := filepath.Base(dstfile)
-	path := filepath.Dir(dstfile)
+	client := ssh.NewClient(c, chans, reqs)
+	if bastion != nil {
+		go func() {
+			client.Wait()
+			bastion.Close()
+		}()
+	}
+	return client, nil
+}
 
-	b := make([]byte, 1024*1024)
+// defaultPort used when SSHAddr has none
+const defaultPort = "22"
 
-	if s.gzip {
-		name = name + ".gz"
-		cb := bytes.NewBuffer(nil)
-		w := gzip.NewWriter(cb)
+// normalizeAddr check addr is host[:port], add the default port when it is
+// missing and bracket IPv6 literals. A bare IPv6 literal is taken as a host.
+func normalizeAddr(addr string) (string, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		host, port = addr, defaultPort
+		if strings.HasPrefix(host, "[") && strings.HasSuffix(host, "]") {
+			host = host[1 : len(host)-1]
+		}
+		ip := host
+		if i := strings.LastIndex(ip, "%"); i >= 0 {
+			ip = ip[:i]
+		}
+		if strings.Contains(host, ":") && net.ParseIP(ip) == nil {
+			return "", ErrBadAddress{Addr: addr, Reason: "expect host:port, with IPv6 literals in brackets like [::1]:22"}
+		}
+	}
+	if host == "" {
+		return "", ErrBadAddress{Addr: addr, Reason: "missing host"}
+	}
+	if n, err := strconv.Atoi(port); err != nil || n <= 0 || n > 65535 {
+		return "", ErrBadAddress{Addr: addr, Reason: fmt.Sprintf("bad port %q", port)}
+	}
+	return net.JoinHostPort(host, port), nil
+}
 
-		for {
-			if n, err := r.Read(b); err == io.EOF {
-				break
-			} else if err != nil {
-				return err
-			} else {
-				if _, err = w.Write(b[0:n]); err != nil {
-					return err
-				}
-			}
+// dialConn open the transport to SSHAddr, directly or through the last jump
+// host, which is returned so it can be closed along with the final client
+func (d Dialer) dialConn(ctx context.Context, timeout time.Duration) (*ssh.Client, net.Conn, error) {
+	if len(d.Jump) == 0 && d.DialFunc != nil {
+		conn, err := d.DialFunc("tcp", d.SSHAddr)
+		if err != nil {
+			return nil, nil, d.timeoutError(err, timeout)
+		}
+		return nil, conn, nil
+	} else if len(d.Jump) == 0 {
+		nd := net.Dialer{Timeout: timeout}
+		conn, err := nd.DialContext(ctx, "tcp", d.SSHAddr)
+		if err != nil {
+			return nil, nil, d.timeoutError(err, timeout)
 		}
+		return nil, conn, nil
+	}
 
-		w.Flush()
-		r = cb
-		size = int64(cb.Len())
+	jump := d.Jump
+	if d.DialFunc != nil && jump[0].DialFunc == nil {
+		jump = append([]Dialer(nil), jump...)
+		jump[0].DialFunc = d.DialFunc
+	}
+	hop := jump[len(jump)-1]
+	if len(jump) > 1 {
+		hop.Jump = jump[:len(jump)-1]
+	}
+	bastion, err := hop.DialContext(ctx)
+	if err != nil {
+		return nil, nil, err
 	}
-	return copy(size, os.ModePerm, name, r, path, session, s.flags)
+	conn, err := bastion.Dial("tcp", d.SSHAddr)
+	if err != nil {
+		bastion.Close()
+		return nil, nil, err
+	}
+	return bastion, conn, nil
 }
 
-func (s *scpHelperDelegate) MustCopy(r io.Reader, size int64, dstfile string) {
-	retryTimes := 0
+// timeoutError wrap err into ErrDialTimeout when it is a network timeout and
+// a timeout was set
+func (d Dialer) timeoutError(err error, timeout time.Duration) error {
+	var nerr net.Error
+	if timeout > 0 && errors.As(err, &nerr) && nerr.Timeout() {
+		return &ErrDialTimeout{Addr: d.SSHAddr, Timeout: timeout, Err: err}
+	}
+	return err
+}
 
-	for {
-		if retryTimes > 10 {
-			time.Sleep(time.Minute)
-		} else if retryTimes > 0 {
-			time.Sleep(time.Duration(retryTimes) * time.Second)
-		}
-		retryTimes++
-		if err := s.Copy(r, size, dstfile); err == nil {
-			return
-		}
+// authError wrap a handshake err into ErrAuth when the server rejected every
+// method, x/crypto/ssh only tell it by the message
+func (d Dialer) authError(err error) error {
+	if strings.Contains(err.Error(), "unable to authenticate") {
+		return ErrAuth{User: d.SSHUser, Addr: d.SSHAddr, Err: err}
 	}
+	return err
 }
 
-func (s *scpHelperDelegate) TryCopy(r io.Reader, size int64, dstfile string, trys int) error {
-	retryTimes := 0
-	var err error
+// DialRetryContext like DialContext, but retry transient failures with
+// DialBackoff until it succeed or ctx is done
+func (d Dialer) DialRetryContext(ctx context.Context) (*ssh.Client, error) {
+	backoff := d.DialBackoff
+	if backoff == nil {
+		backoff = DefaultBackoff
+	}
 
-	for {
-		if retryTimes > trys {
-			return &ErrTimes{times: retryTimes, err: err}
-		} else if retryTimes > 0 {
-			time.Sleep(time.Duration(retryTimes) * time.Second)
+	for attempt := 1; ; attempt++ {
+		client, err := d.DialContext(ctx)
+		if err == nil {
+			return client, nil
 		}
-		retryTimes++
-		if err := s.Copy(r, size, dstfile); err == nil {
-			return nil
+		if !RetryableError(err) {
+			return nil, ErrDialAttempts{Addr: d.SSHAddr, Attempts: attempt, Err: err}
+		}
+
+		timer := time.NewTimer(backoff(attempt))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ErrDialAttempts{Addr: d.SSHAddr, Attempts: attempt, Err: err}
+		case <-timer.C:
 		}
 	}
 }
 
-func (s scpHelperDelegate) openFile(filename string) (io.ReadCloser, int64, error) {
-	fd, err := os.Open(filename)
+// clientConfig build ssh config, release must be called once the handshake is done
+func (d Dialer) clientConfig() (*ssh.ClientConfig, func(), error) {
+	var auths []ssh.AuthMethod
+	release := func() {}
+	if d.SSHUseAgent {
+		if conn, err := dialAgent(); err == nil {
+			auths = append(auths, ssh.PublicKeysCallback(agent.NewClient(conn).Signers))
+			release = func() { conn.Close() }
+		}
+	}
+
+	hostKeyCallback, err := d.hostKeyCallback()
 	if err != nil {
-		return nil, 0, err
+		release()
+		return nil, nil, err
 	}
 
-	stat, err := fd.Stat()
+	key, err := d.signer()
 	if err != nil {
-		return nil, 0, err
+		release()
+		return nil, nil, err
+	}
+	if key != nil {
+		auths = append(auths, ssh.PublicKeys(key))
+	}
+	// password is tried after the key, an empty one is never sent as it
+	// count against the server MaxAuthTries
+	if d.SSHPassCallback != nil {
+		auths = append(auths, ssh.PasswordCallback(d.SSHPassCallback))
+	} else if d.SSHPass != "" {
+		auths = append(auths, ssh.Password(d.SSHPass))
+	}
+	if d.KeyboardInteractiveFunc != nil {
+		auths = append(auths, ssh.KeyboardInteractive(d.KeyboardInteractiveFunc))
 	}
-	return fd, stat.Size(), nil
-}
 
-func (s *scpHelperDelegate) CopyPath(srcfile, dstfile string) error {
-	fd, size, err := s.openFile(srcfile)
-	if err == nil {
-		return s.Copy(fd, size, dstfile)
+	if err = d.checkAlgorithms(); err != nil {
+		release()
+		return nil, nil, err
 	}
-	return err
+	if err = d.checkClientVersion(); err != nil {
+		release()
+		return nil, nil, err
+	}
+
+	timeout := d.DialTimeout
+	if timeout <= 0 {
+		timeout = defaultDialTimeout
+	}
+
+	config := &ssh.ClientConfig{
+		Config: ssh.Config{
+			Ciphers:      d.Ciphers,
+			MACs:         d.MACs,
+			KeyExchanges: d.KeyExchanges,
+		},
+		Auth:              auths,
+		User:              d.SSHUser,
+		HostKeyCallback:   hostKeyCallback,
+		HostKeyAlgorithms: d.HostKeyAlgorithms,
+		ClientVersion:     d.ClientVersion,
+		Timeout:           timeout,
+	}
+	if d.ConfigureClient != nil {
+		d.ConfigureClient(config)
+	}
+	return config, release, nil
 }
 
-func (s *scpHelperDelegate) MustCopyPath(srcfile, dstfile string) {
-	if fd, size, err := s.openFile(srcfile); err != nil {
-		panic(err)
-	} else {
-		s.MustCopy(fd, size, dstfile)
+// maxClientVersion length of the identification line without CR LF, RFC 4253
+const maxClientVersion = 253
+
+// checkClientVersion reject a ClientVersion the server would not parse, empty
+// keep the default
+func (d Dialer) checkClientVersion() error {
+	v := d.ClientVersion
+	if v == "" {
+		return nil
+	}
+	if !strings.HasPrefix(v, "SSH-2.0-") {
+		return ErrClientVersion{Version: v, Reason: `must start with "SSH-2.0-"`}
+	}
+	if len(v) > maxClientVersion {
+		return ErrClientVersion{Version: v, Reason: fmt.Sprintf("longer than %d bytes", maxClientVersion)}
 	}
+	for _, c := range []byte(v) {
+		if c < ' ' || c > '~' {
+			return ErrClientVersion{Version: v, Reason: "must be printable ASCII"}
+		}
+	}
+	return nil
 }
 
-func (s *scpHelperDelegate) TryCopyPath(srcfile, dstfile string, trys int) error {
-	fd, size, err := s.openFile(srcfile)
-	if err != nil {
+// checkAlgorithms reject names in Ciphers, MACs and KeyExchanges unknown to x/crypto/ssh
+func (d Dialer) checkAlgorithms() error {
+	supported, insecure := ssh.SupportedAlgorithms(), ssh.InsecureAlgorithms()
+	check := func(kind string, names, valid []string) error {
+		for _, name := range names {
+			found := false
+			for _, v := range valid {
+				if v == name {
+					found = true
+					break
+				}
+			}
+			if !found {
+				return ErrUnsupportedAlgorithm{Kind: kind, Name: name, Supported: valid}
+			}
+		}
+		return nil
+	}
+
+	if err := check("cipher", d.Ciphers, append(supported.Ciphers, insecure.Ciphers...)); err != nil {
+		return err
+	}
+	if err := check("mac", d.MACs, append(supported.MACs, insecure.MACs...)); err != nil {
 		return err
 	}
-	return s.TryCopy(fd, size, dstfile, trys)
+	return check("key exchange", d.KeyExchanges, append(supported.KeyExchanges, insecure.KeyExchanges...))
 }
 
-func (s *scpHelperDelegate) SetLimitKB(kbs int) {
-	s.flags = fmt.Sprintf("-l %d", kbs*8)
-}
+// signer parse SSHKeyBytes or else SSHFile, nil when neither is set
+func (d Dialer) signer() (ssh.Signer, error) {
+	b, name := d.SSHKeyBytes, "SSHKeyBytes"
+	if len(b) == 0 {
+		if d.SSHFile == "" {
+			return nil, nil
+		}
+		var err error
+		if b, err = ioutil.ReadFile(d.SSHFile); err != nil {
+			return nil, ErrKeyRead{Path: d.SSHFile, Err: err}
+		}
+		name = d.SSHFile
+	}
 
-func (s *scpHelperDelegate) SetGzipEnable(enable bool) {
-	s.gzip = enable
+	var key ssh.Signer
+	var err error
+	if d.SSHPassphrase != "" {
+		key, err = ssh.ParsePrivateKeyWithPassphrase(b, []byte(d.SSHPassphrase))
+	} else {
+		key, err = ssh.ParsePrivateKey(b)
+	}
+	if _, ok := err.(*ssh.PassphraseMissingError); ok {
+		return nil, ErrKeyParse{Path: name, Err: fmt.Errorf("encrypted, SSHPassphrase required")}
+	} else if err != nil {
+		return nil, ErrKeyParse{Path: name, Err: err}
+	} else if d.SSHCertFile == "" {
+		return key, nil
+	}
+	return d.certSigner(key)
+}
+
+// certSigner pair key with SSHCertFile, checking the cert is usable for SSHUser now
+func (d Dialer) certSigner(key ssh.Signer) (ssh.Signer, error) {
+	b, err := ioutil.ReadFile(d.SSHCertFile)
+	if err != nil {
+		return nil, err
+	}
+	pub, _, _, _, err := ssh.ParseAuthorizedKey(b)
+	if err != nil {
+		return nil, ErrCertificate{Path: d.SSHCertFile, Reason: err.Error()}
+	}
+	cert, ok := pub.(*ssh.Certificate)
+	if !ok {
+		return nil, ErrCertificate{Path: d.SSHCertFile, Reason: "not a certificate"}
+	}
+	if cert.CertType != ssh.UserCert {
+		return nil, ErrCertificate{Path: d.SSHCertFile, Reason: "not a user certificate"}
+	}
+
+	now := uint64(time.Now().Unix())
+	if now < cert.ValidAfter {
+		return nil, ErrCertificate{Path: d.SSHCertFile, Reason: fmt.Sprintf("not valid before %s", time.Unix(int64(cert.ValidAfter), 0))}
+	}
+	if cert.ValidBefore != ssh.CertTimeInfinity && now >= cert.ValidBefore {
+		return nil, ErrCertificate{Path: d.SSHCertFile, Reason: fmt.Sprintf("expired at %s", time.Unix(int64(cert.ValidBefore), 0))}
+	}
+	if len(cert.ValidPrincipals) > 0 {
+		found := false
+		for _, p := range cert.ValidPrincipals {
+			if p == d.SSHUser {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, ErrCertificate{Path: d.SSHCertFile, Reason: fmt.Sprintf("user %s not in principals %v", d.SSHUser, cert.ValidPrincipals)}
+		}
+	}
+
+	signer, err := ssh.NewCertSigner(cert, key)
+	if err != nil {
+		return nil, ErrCertificate{Path: d.SSHCertFile, Reason: err.Error()}
+	}
+	return signer, nil
+}
+
+func (d Dialer) hostKeyCallback() (ssh.HostKeyCallback, error) {
+	if d.HostKeyCallback != nil {
+		return d.HostKeyCallback, nil
+	}
+	file := d.KnownHostsFile
+	if file == "" {
+		if d.InsecureIgnoreHostKey {
+			return ssh.InsecureIgnoreHostKey(), nil
+		}
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, err
+		}
+		file = filepath.Join(home, ".ssh", "known_hosts")
+	}
+
+	callback, err := knownhosts.New(file)
+	if err != nil {
+		return nil, err
+	}
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		err := callback(hostname, remote, key)
+		if kerr, ok := err.(*knownhosts.KeyError); ok && len(kerr.Want) > 0 {
+			return &HostKeyMismatchError{Hostname: hostname, Key: key, Err: kerr}
+		}
+		return err
+	}, nil
+}
+
+// dialAgent connect the ssh-agent named by SSH_AUTH_SOCK
+func dialAgent() (net.Conn, error) {
+	sock := os.Getenv("SSH_AUTH_SOCK")
+	if sock == "" {
+		return nil, fmt.Errorf("SSH_AUTH_SOCK not set")
+	}
+	return net.Dial("unix", sock)
+}
+
+// watchContext close c once ctx is done, the returned stop func end the
+// watch and report whether c was closed because of ctx
+func watchContext(ctx context.Context, c io.Closer) func() bool {
+	stop := make(chan struct{})
+	closed := make(chan bool)
+	go func() {
+		select {
+		case <-ctx.Done():
+			c.Close()
+			closed <- true
+		case <-stop:
+			closed <- false
+		}
+	}()
+	return func() bool {
+		close(stop)
+		return <-closed
+	}
+}
+
+// keepAlive send keepalive@openssh.com on client every interval, a request
+// unanswered within interval close client so the next session redial
+func keepAlive(client *ssh.Client, interval time.Duration, logger Logger, addr string) {
+	if interval <= 0 {
+		return
+	}
+	done := make(chan struct{})
+	go func() {
+		client.Wait()
+		close(done)
+	}()
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+
+			errc := make(chan error, 1)
+			go func() {
+				_, _, err := client.SendRequest("keepalive@openssh.com", true, nil)
+				errc <- err
+			}()
+			var err error
+			select {
+			case err = <-errc:
+			case <-done:
+				return
+			case <-time.After(interval):
+				err = fmt.Errorf("no reply within %s", interval)
+			}
+			if err != nil {
+				logger.Warnf("keepalive %s fail, closing connection: %v", addr, err)
+				client.Close()
+				return
+			}
+		}
+	}()
+}
+
+type scpHelperDelegate struct {
+	// dryRunBytes first to stay 64-bit aligned for atomic
+	dryRunBytes int64
+
+	dialer *Dialer
+	client *ssh.Client
+	shared *pooledClient
+	lock   sync.RWMutex
+	flags  string
+
+	// external client is owned by the caller
+	external bool
+	// sftp transfer over the sftp subsystem instead of scp
+	sftp bool
+
+	compression Compression
+	level       int
+	mode        os.FileMode
+	atomic      bool
+	resume      bool
+
+	followSymlinks  bool
+	continueOnError bool
+	preserveTimes   bool
+	progress        func(copied, total int64)
+
+	backoff          BackoffFunc
+	maxRetryDuration time.Duration
+	keepAlive        time.Duration
+	noJitter         bool
+
+	env       map[string]string
+	envStrict bool
+
+	skipIdentical  bool
+	verifyChecksum bool
+	checksumCmd    string
+
+	logger  Logger
+	metrics Metrics
+	limiter *RateLimiter
+	// localLimiter cap this helper alone, on top of limiter
+	localLimiter *RateLimiter
+
+	dryRun bool
+
+	mkdirParents bool
+	mkdirMode    os.FileMode
+
+	// suffix replace the compression suffix when suffixSet
+	suffix      string
+	suffixSet   bool
+	transparent bool
+
+	bufferSize      int
+	transferTimeout time.Duration
+
+	chmod os.FileMode
+	chown string
+
+	preCommand  string
+	postCommand string
+
+	minRatio float64
+	minSize  int64
+
+	maxFileSize int64
+
+	checkDiskSpace bool
+	spaceMargin    int64
+
+	tempDir       string
+	tempPrefix    string
+	remoteTempDir string
+
+	append bool
+
+	onReconnect func(error)
+
+	hash    hash.Hash
+	wireLog io.Writer
+
+	// version is cached once probed, versionErr only when the probe ran
+	// but found no OpenSSH version
+	versionLock sync.Mutex
+	versionDone bool
+	version     string
+	versionErr  error
+}
+
+// NewHelper New Scp Helper
+func NewHelper(dialer *Dialer) Helper {
+	return newHelperDelegate(dialer)
+}
+
+// NewHelperFromClient New Scp Helper over a client owned by the caller, the
+// helper never dial and its Close leave client open
+func NewHelperFromClient(client *ssh.Client) Helper {
+	s := newHelperDelegate(nil)
+	s.client = client
+	s.external = true
+	return s
+}
+
+func newHelperDelegate(dialer *Dialer) *scpHelperDelegate {
+	return &scpHelperDelegate{dialer: dialer, backoff: DefaultBackoff, checksumCmd: "sha256sum", logger: nopLogger{}, metrics: nopMetrics{}, minRatio: defaultMinRatio, spaceMargin: defaultSpaceMargin, tempPrefix: defaultTempPrefix}
+}
+
+func (s *scpHelperDelegate) newSession() (*ssh.Session, error) {
+	return s.newSessionContext(context.Background())
+}
+
+// newSessionContext open a session with the configured env exported
+func (s *scpHelperDelegate) newSessionContext(ctx context.Context) (*ssh.Session, error) {
+	session, err := s.openSession(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0, len(s.env))
+	for name := range s.env {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if err = session.Setenv(name, s.env[name]); err != nil && s.envStrict {
+			session.Close()
+			return nil, ErrSetenv{Name: name, Err: err}
+		} else if err != nil {
+			s.logger.Warnf("setenv %s rejected by remote, continue without it: %v", name, err)
+		}
+	}
+	return session, nil
+}
+
+func (s *scpHelperDelegate) openSession(ctx context.Context) (*ssh.Session, error) {
+	s.lock.RLock()
+	shared := s.shared
+	s.lock.RUnlock()
+	if shared != nil {
+		return shared.newSession(ctx, s.logger, s.keepAlive, s.onReconnect)
+	}
+	if s.external {
+		return s.client.NewSession()
+	}
+
+	// dropped session error handed to onReconnect, called once unlocked so it
+	// may use the helper
+	var dropped error
+	defer func() {
+		if dropped != nil && s.onReconnect != nil {
+			s.onReconnect(dropped)
+		}
+	}()
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	var err error
+	if s.client == nil {
+		s.logger.Debugf("dial %s@%s", s.dialer.SSHUser, s.dialer.SSHAddr)
+		if s.client, err = s.dialer.DialContext(ctx); err != nil {
+			s.logger.Warnf("dial %s fail: %v", s.dialer.SSHAddr, err)
+			return nil, err
+		}
+		keepAlive(s.client, s.keepAlive, s.logger, s.dialer.SSHAddr)
+	}
+
+	// first is kept and joined to later errors, it is usually why the
+	// connection is dead
+	sess, first := s.client.NewSession()
+	if first == nil {
+		return sess, nil
+	}
+	var refused *ssh.OpenChannelError
+	if errors.As(first, &refused) {
+		// the connection is alive, e.g. at MaxSessions, keep it for the
+		// sessions in flight
+		return nil, first
+	}
+	s.logger.Warnf("new session on %s fail, reconnecting: %v", s.dialer.SSHAddr, first)
+	s.client.Close()
+	s.client = nil
+	dropped = first
+
+	if err = ctx.Err(); err != nil {
+		return nil, errors.Join(first, err)
+	}
+	s.logger.Debugf("redial %s@%s", s.dialer.SSHUser, s.dialer.SSHAddr)
+	if s.client, err = s.dialer.DialContext(ctx); err != nil {
+		s.logger.Warnf("redial %s fail: %v", s.dialer.SSHAddr, err)
+		return nil, errors.Join(first, err)
+	}
+	keepAlive(s.client, s.keepAlive, s.logger, s.dialer.SSHAddr)
+
+	if sess, err = s.client.NewSession(); err != nil {
+		return nil, errors.Join(first, err)
+	}
+	return sess, nil
+}
+
+func (s *scpHelperDelegate) Copy(r io.Reader, size int64, dstfile string) error {
+	return s.CopyContext(context.Background(), r, size, dstfile)
+}
+
+// CopyContext like Copy, but close the session and return ctx.Err() once
+// ctx is done
+func (s *scpHelperDelegate) CopyContext(ctx context.Context, r io.Reader, size int64, dstfile string) error {
+	return s.copyContext(ctx, r, size, dstfile, 0, nil)
+}
+
+// CopyBytes copy data to dstfile
+func (s *scpHelperDelegate) CopyBytes(data []byte, dstfile string) error {
+	return s.Copy(bytes.NewReader(data), int64(len(data)), dstfile)
+}
+
+// CopyString copy data to dstfile
+func (s *scpHelperDelegate) CopyString(data, dstfile string) error {
+	return s.Copy(strings.NewReader(data), int64(len(data)), dstfile)
+}
+
+// CopyAuto like Copy, the size is taken from r when it can tell it, else r
+// is spooled to a temp file first
+func (s *scpHelperDelegate) CopyAuto(r io.Reader, dstfile string) error {
+	size, err := readerSize(r)
+	if err == nil {
+		return s.Copy(r, size, dstfile)
+	}
+
+	rp, err := s.newReplayReader(r)
+	if err != nil {
+		return err
+	}
+	defer rp.Close()
+	if size, err = rp.rs.Seek(0, io.SeekEnd); err != nil {
+		return err
+	}
+	if r, err = rp.rewind(); err != nil {
+		return err
+	}
+	return s.Copy(r, size-rp.start, dstfile)
+}
+
+// readerSize bytes left in r, an error when r can not tell
+func readerSize(r io.Reader) (int64, error) {
+	switch v := r.(type) {
+	case *bytes.Reader:
+		return int64(v.Len()), nil
+	case *bytes.Buffer:
+		return int64(v.Len()), nil
+	case *strings.Reader:
+		return int64(v.Len()), nil
+	case *os.File:
+		info, err := v.Stat()
+		if err != nil {
+			return 0, err
+		}
+		if !info.Mode().IsRegular() {
+			return 0, fmt.Errorf("%s is not a regular file", v.Name())
+		}
+	}
+
+	seeker, ok := r.(io.Seeker)
+	if !ok {
+		return 0, fmt.Errorf("size of %T unknown", r)
+	}
+	cur, err := seeker.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return 0, err
+	}
+	end, err := seeker.Seek(0, io.SeekEnd)
+	if err != nil {
+		return 0, err
+	}
+	if _, err = seeker.Seek(cur, io.SeekStart); err != nil {
+		return 0, err
+	}
+	return end - cur, nil
+}
+
+// CopyMulti copy the same size bytes of r to every dstpaths, over the one
+// cached connection with a session per destination. Failed destinations are
+// returned as ErrFiles whose Path is the destination.
+func (s *scpHelperDelegate) CopyMulti(r io.ReaderAt, size int64, dstpaths []string) error {
+	var errs ErrFiles
+	for _, dst := range dstpaths {
+		if err := s.CopyReaderAt(r, size, dst); err != nil {
+			errs = append(errs, &ErrFile{Path: dst, Err: err})
+		}
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// CopyWithTimes like Copy, but the remote file get mtime and atime
+func (s *scpHelperDelegate) CopyWithTimes(r io.Reader, size int64, dstfile string, mtime, atime time.Time) error {
+	return s.copyContext(context.Background(), r, size, dstfile, 0, &fileTimes{mtime: mtime, atime: atime})
+}
+
+// CopyStream return a writer spooling to a local temp file, the content is
+// uploaded as dstfile when it is closed, so its size need not be known ahead
+func (s *scpHelperDelegate) CopyStream(dstfile string) (io.WriteCloser, error) {
+	tmp, err := s.tempFile("stream")
+	if err != nil {
+		return nil, err
+	}
+	return &streamWriter{helper: s, tmp: tmp, dstfile: dstfile}, nil
+}
+
+// streamWriter spool of CopyStream
+type streamWriter struct {
+	helper  *scpHelperDelegate
+	tmp     *os.File
+	dstfile string
+	closed  bool
+}
+
+func (w *streamWriter) Write(p []byte) (int, error) {
+	return w.tmp.Write(p)
+}
+
+// Close upload the spooled content and remove the temp file
+func (w *streamWriter) Close() error {
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+	defer os.Remove(w.tmp.Name())
+	defer w.tmp.Close()
+
+	info, err := w.tmp.Stat()
+	if err != nil {
+		return err
+	}
+	if _, err = w.tmp.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	return w.helper.copyContext(context.Background(), w.tmp, info.Size(), w.dstfile, 0, nil)
+}
+
+// CopyTo copy r as name inside dstDir, unlike Copy no path splitting is done,
+// so dstDir may end with a slash and name is never taken as a directory
+func (s *scpHelperDelegate) CopyTo(r io.Reader, size int64, dstDir, name string) error {
+	return s.copyTo(context.Background(), r, size, dstDir, name, 0, nil)
+}
+
+// copyContext upload r as dstfile with mode, see copyTo
+func (s *scpHelperDelegate) copyContext(ctx context.Context, r io.Reader, size int64, dstfile string, mode os.FileMode, times *fileTimes) error {
+	return s.copyTo(ctx, r, size, filepath.Dir(dstfile), filepath.Base(dstfile), mode, times)
+}
+
+// copyTo send bounded by the transfer timeout, between the pre and post commands
+func (s *scpHelperDelegate) copyTo(ctx context.Context, r io.Reader, size int64, path, name string, mode os.FileMode, times *fileTimes) error {
+	// reject before the pre command, it may stop a service only the post
+	// command restart
+	if err := s.checkSize(size); err != nil {
+		return err
+	}
+	tctx, cancel := s.transferContext(ctx)
+	defer cancel()
+	err := s.hook(tctx, s.preCommand)
+	if err == nil {
+		err = s.send(tctx, r, size, path, name, mode, times)
+	}
+	if err == nil {
+		err = s.hook(tctx, s.postCommand)
+	}
+	return s.expired(ctx, err)
+}
+
+// checkSize reject a file larger than SetMaxFileSize
+func (s *scpHelperDelegate) checkSize(size int64) error {
+	if s.maxFileSize > 0 && size > s.maxFileSize {
+		return ErrFileTooLarge{Size: size, Limit: s.maxFileSize}
+	}
+	return nil
+}
+
+// send upload r as path/name with mode, unless SetMode pinned another one,
+// zero mode mean os.ModePerm
+func (s *scpHelperDelegate) send(ctx context.Context, r io.Reader, size int64, path, name string, mode os.FileMode, times *fileTimes) (err error) {
+	if err = s.checkSize(size); err != nil {
+		return err
+	}
+	if s.dryRun {
+		return s.dryRunCopy(r, size, path, name, mode, times)
+	}
+
+	s.metrics.OnTransferStart()
+	start := time.Now()
+	defer func() {
+		if err != nil {
+			size = 0
+		}
+		s.metrics.OnTransferEnd(size, time.Since(start), err)
+	}()
+
+	if s.hash != nil {
+		s.hash.Reset()
+	}
+	if s.mode != 0 {
+		mode = s.mode
+	} else if mode == 0 {
+		mode = os.ModePerm
+	}
+	if s.append {
+		return s.sendAppend(ctx, r, size, path, name)
+	}
+
+	var h hash.Hash
+	if s.verifyChecksum {
+		h = sha256.New()
+	}
+	// size become the compressed size, plainSize keep the original
+	plainSize := size
+	compressed, compressing := false, s.compressing(size)
+	if compressing {
+		cb, plain, release, err := s.compress(r, h)
+		if err != nil {
+			return err
+		}
+		defer release()
+		if plain != nil {
+			s.logger.Debugf("%s compression of %s save less than %g, send it plain", s.compression, name, s.minRatio)
+			r = plain
+		} else {
+			compressed = true
+			name = s.compressedName(name)
+			r = cb
+			size = int64(cb.Len())
+		}
+	}
+	// transparent uploads are decompressed remotely, so compare the plain sum
+	transparent := s.transparent && compressed
+	switch {
+	case h == nil, transparent, compressing && !compressed:
+		// h already hold the plain content read by compress
+	default:
+		h = sha256.New()
+		r = io.TeeReader(r, h)
+	}
+	// dir where the file is uploaded, the temp dir of atomic uploads if any
+	target, dir := filepath.Join(path, name), path
+	if s.atomic {
+		name = atomicName(name)
+		if s.remoteTempDir != "" {
+			dir = s.remoteTempDir
+		}
+	}
+
+	if err = s.makeParents(ctx, path); err != nil {
+		return err
+	}
+	// transparent uploads take the plain size once decompressed
+	need := size
+	if transparent {
+		need = plainSize
+	}
+	if err = s.checkSpace(ctx, dir, need); err != nil {
+		return err
+	}
+	if transparent {
+		if s.hash != nil {
+			r = io.TeeReader(r, s.hash)
+		}
+		err = s.decompressTo(ctx, s.limit(ctx, r), mode, filepath.Join(dir, name), times)
+	} else {
+		err = s.upload(ctx, s.limit(ctx, r), size, mode, dir, name, times)
+	}
+	if ctx.Err() != nil {
+		err = ctx.Err()
+	}
+	if err == nil && h != nil {
+		err = s.verify(ctx, filepath.Join(dir, name), hex.EncodeToString(h.Sum(nil)))
+	}
+	if err == nil {
+		err = s.setOwnership(ctx, filepath.Join(dir, name))
+	}
+	if s.atomic {
+		tmp := filepath.Join(dir, name)
+		if err == nil {
+			err = s.run(ctx, fmt.Sprintf("mv -f -- %s %s", shellQuote(tmp), shellQuote(target)))
+		}
+		if err != nil {
+			s.run(context.Background(), "rm -f -- "+shellQuote(tmp))
+		}
+	} else if _, ok := err.(SizeMismatchError); ok {
+		// the aborted upload left a truncated file
+		s.run(context.Background(), "rm -f -- "+shellQuote(target))
+	}
+	return err
+}
+
+// sendAppend append size bytes of r to path/name, which is created when
+// absent. It is sent plain, not verified and not atomic.
+func (s *scpHelperDelegate) sendAppend(ctx context.Context, r io.Reader, size int64, path, name string) error {
+	if err := s.makeParents(ctx, path); err != nil {
+		return err
+	}
+	lr := &io.LimitedReader{R: r, N: size}
+	r = lr
+	if s.hash != nil {
+		r = io.TeeReader(r, s.hash)
+	}
+	dstfile := filepath.Join(path, name)
+	err := s.appendTo(ctx, r, dstfile)
+	if err == nil && lr.N > 0 {
+		err = SizeMismatchError{Size: size, Actual: size - lr.N}
+	}
+	if err == nil {
+		err = s.setOwnership(ctx, dstfile)
+	}
+	return err
+}
+
+// defaultMinRatio compression must save 5% or the file is sent plain
+const defaultMinRatio = 0.05
+
+// compress r in memory, feeding the plain content to h when not nil. When
+// it save less than the min ratio, plain replay the original content instead,
+// spooled to a temp file when r can not seek. release free the spool.
+func (s *scpHelperDelegate) compress(r io.Reader, h hash.Hash) (compressed *bytes.Buffer, plain io.Reader, release func(), err error) {
+	release = func() {}
+	src := r
+	var replay func() (io.Reader, error)
+	if rs, ok := r.(io.ReadSeeker); ok && s.minRatio > 0 {
+		if start, err := rs.Seek(0, io.SeekCurrent); err == nil {
+			replay = func() (io.Reader, error) {
+				_, err := rs.Seek(start, io.SeekStart)
+				return rs, err
+			}
+		}
+	}
+	if replay == nil && s.minRatio > 0 {
+		// keep the plain content out of memory, beside the compressed one
+		tmp, err := s.tempFile("compress")
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		os.Remove(tmp.Name())
+		release = func() { tmp.Close() }
+		src = io.TeeReader(r, tmp)
+		replay = func() (io.Reader, error) {
+			_, err := tmp.Seek(0, io.SeekStart)
+			return tmp, err
+		}
+	}
+	if h != nil {
+		src = io.TeeReader(src, h)
+	}
+
+	cb := bytes.NewBuffer(nil)
+	w, err := s.compression.newWriter(cb, s.level)
+	if err != nil {
+		release()
+		return nil, nil, nil, err
+	}
+	n, err := copyBuffer(w, src, 0)
+	if err == nil {
+		err = w.Close()
+	}
+	if err != nil {
+		release()
+		return nil, nil, nil, err
+	}
+
+	if replay != nil && float64(cb.Len()) > float64(n)*(1-s.minRatio) {
+		if plain, err = replay(); err != nil {
+			release()
+			return nil, nil, nil, err
+		}
+		return nil, plain, release, nil
+	}
+	release()
+	return cb, nil, func() {}, nil
+}
+
+// compressing a file of size is compressed, it must exceed the min size
+func (s *scpHelperDelegate) compressing(size int64) bool {
+	return s.compression != None && size > s.minSize
+}
+
+// compressedName remote name of a compressed upload of name
+func (s *scpHelperDelegate) compressedName(name string) string {
+	if s.transparent {
+		return name
+	}
+	if s.suffixSet {
+		return name + s.suffix
+	}
+	return name + s.compression.suffix()
+}
+
+// upload send a single file as path/name through the scp sink, or sftp
+func (s *scpHelperDelegate) upload(ctx context.Context, r io.Reader, size int64, mode os.FileMode, path, name string, times *fileTimes) error {
+	if s.sftp {
+		return s.sftpUpload(ctx, r, size, mode, path, name, times)
+	}
+
+	session, err := s.newSessionContext(ctx)
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+	stop := watchContext(ctx, session)
+	defer stop()
+
+	return copy(size, mode, name, r, path, session, copyOptions{flags: s.scpFlags(), times: times, progress: s.progress, bufferSize: s.bufferSize, hash: s.hash, wire: s.wireLog})
+}
+
+// decompressTo pipe compressed r through the remote decompressor into dstfile,
+// in place of the scp sink
+func (s *scpHelperDelegate) decompressTo(ctx context.Context, r io.Reader, mode os.FileMode, dstfile string, times *fileTimes) error {
+	quoted := shellQuote(dstfile)
+	cmd := fmt.Sprintf("%s > %s && chmod %o -- %s", s.compression.decompressCmd(), quoted, mode, quoted)
+	if times != nil {
+		// -t is read in the remote local time, pin it to UTC
+		cmd += fmt.Sprintf(" && TZ=UTC touch -m -t %s %s && TZ=UTC touch -a -t %s %s",
+			times.mtime.UTC().Format("200601021504.05"), quoted, times.atime.UTC().Format("200601021504.05"), quoted)
+	}
+	return s.pipe(ctx, r, cmd)
+}
+
+// transferContext bound ctx by the transfer timeout, if any
+func (s *scpHelperDelegate) transferContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if s.transferTimeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, s.transferTimeout)
+}
+
+// expired turn err into TimeoutError when the transfer timeout, and not
+// parent, is the deadline that stopped it
+func (s *scpHelperDelegate) expired(parent context.Context, err error) error {
+	if err != nil && s.transferTimeout > 0 && parent.Err() == nil && errors.Is(err, context.DeadlineExceeded) {
+		return TimeoutError{Timeout: s.transferTimeout}
+	}
+	return err
+}
+
+// opensshVersion match an OpenSSH version and capture its major and minor
+var opensshVersion = regexp.MustCompile(`OpenSSH_(\d+)\.(\d+)[^\s,]*`)
+
+// RemoteVersion OpenSSH version of the remote, e.g. "OpenSSH_9.6p1", probed
+// with ssh -V, or read from the server banner when that fail. The result is
+// kept once the probe ran, a failure to reach the remote is probed again on
+// next call.
+func (s *scpHelperDelegate) RemoteVersion() (string, error) {
+	s.versionLock.Lock()
+	defer s.versionLock.Unlock()
+	if s.versionDone {
+		return s.version, s.versionErr
+	}
+	v, ran, err := s.probeVersion(context.Background())
+	if ran {
+		s.versionDone = true
+		s.version, s.versionErr = v, err
+	}
+	return v, err
+}
+
+// probeVersion ran tell the remote answered, so the result is final
+func (s *scpHelperDelegate) probeVersion(ctx context.Context) (v string, ran bool, err error) {
+	session, err := s.newSessionContext(ctx)
+	if err != nil {
+		return "", false, err
+	}
+	out, err := session.CombinedOutput("ssh -V")
+	session.Close()
+	if v := opensshVersion.FindString(string(out)); v != "" {
+		return v, true, nil
+	}
+	var exit *ssh.ExitError
+	if err != nil && !errors.As(err, &exit) {
+		// the connection failed before ssh -V exited
+		return "", false, err
+	}
+
+	s.lock.RLock()
+	client := s.client
+	s.lock.RUnlock()
+	if client != nil {
+		if v := opensshVersion.FindString(string(client.ServerVersion())); v != "" {
+			return v, true, nil
+		}
+	}
+	return "", true, fmt.Errorf("remote version unknown: %s", strings.TrimSpace(string(out)))
+}
+
+// scpFlags flags of the remote scp, with -O to keep the legacy protocol on
+// OpenSSH 9 and later
+func (s *scpHelperDelegate) scpFlags() string {
+	v, err := s.RemoteVersion()
+	if err != nil {
+		s.logger.Debugf("probe remote version: %v", err)
+		return s.flags
+	}
+	if m := opensshVersion.FindStringSubmatch(v); m != nil {
+		if major, _ := strconv.Atoi(m[1]); major >= 9 {
+			return s.flags + " -O"
+		}
+	}
+	return s.flags
+}
+
+// hook run a pre or post command, skipped in dry-run
+func (s *scpHelperDelegate) hook(ctx context.Context, cmd string) error {
+	if cmd == "" {
+		return nil
+	}
+	if s.dryRun {
+		s.logger.Infof("dry-run: run %s", cmd)
+		return nil
+	}
+	if err := s.run(ctx, cmd); err != nil {
+		return ErrCommand{Cmd: cmd, Err: err}
+	}
+	return nil
+}
+
+// setOwnership apply SetRemoteChmod and SetRemoteChown to file, the remote
+// error carry the reason, e.g. Operation not permitted without root
+func (s *scpHelperDelegate) setOwnership(ctx context.Context, file string) error {
+	if s.chmod != 0 {
+		if err := s.run(ctx, fmt.Sprintf("chmod %o -- %s", s.chmod, shellQuote(file))); err != nil {
+			return err
+		}
+	}
+	if s.chown != "" {
+		return s.run(ctx, fmt.Sprintf("chown -- %s %s", shellQuote(s.chown), shellQuote(file)))
+	}
+	return nil
+}
+
+// defaultTempPrefix start the name of local temp files
+const defaultTempPrefix = "scp-"
+
+// tempFile create a local temp file for kind of use, in the temp dir and
+// with the temp prefix
+func (s *scpHelperDelegate) tempFile(kind string) (*os.File, error) {
+	return ioutil.TempFile(s.tempDir, s.tempPrefix+kind+"-")
+}
+
+// atomicSuffix name of the temp file uploaded before rename in atomic mode
+const atomicSuffix = ".scp.tmp"
+
+// atomicName temp name of name in atomic mode, made unique by the pid and a
+// random part as targets of the same name may share SetRemoteTempDir
+func atomicName(name string) string {
+	return fmt.Sprintf("%s.%d.%08x%s", name, os.Getpid(), rand.Uint32(), atomicSuffix)
+}
+
+// run execute cmd over a new session, a failure carry the remote output
+func (s *scpHelperDelegate) run(ctx context.Context, cmd string) error {
+	session, err := s.newSessionContext(ctx)
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+
+	// CombinedOutput serialize the stdout and stderr copies into one buffer
+	output, err := session.CombinedOutput(cmd)
+	return remoteError(session, bytes.NewBuffer(output), err)
+}
+
+// defaultMkdirMode mode of directories created by SetMkdirParents
+const defaultMkdirMode = 0755
+
+// makeParents create dir and its missing parents when SetMkdirParents is on
+func (s *scpHelperDelegate) makeParents(ctx context.Context, dir string) error {
+	if !s.mkdirParents {
+		return nil
+	}
+	mode := s.mkdirMode
+	if mode == 0 {
+		mode = defaultMkdirMode
+	}
+	// umask apply the mode to every created parent, unlike mkdir -m
+	return s.run(ctx, fmt.Sprintf("umask %03o && mkdir -p -- %s", os.ModePerm&^mode, shellQuote(dir)))
+}
+
+// defaultSpaceMargin free space kept beyond the upload by SetCheckDiskSpace
+const defaultSpaceMargin = 16 << 20
+
+// checkSpace fail with ErrInsufficientSpace when dir can not hold size bytes
+// plus the margin, when SetCheckDiskSpace is on
+func (s *scpHelperDelegate) checkSpace(ctx context.Context, dir string, size int64) error {
+	if !s.checkDiskSpace {
+		return nil
+	}
+	session, err := s.newSessionContext(ctx)
+	if err != nil {
+		return err
+	}
+	avail, err := FreeSpace(dir, session)
+	if err != nil {
+		return err
+	}
+	if need := size + s.spaceMargin; avail < need {
+		return ErrInsufficientSpace{Dir: dir, Need: need, Avail: avail}
+	}
+	return nil
+}
+
+// verify compare local sum with the sum of remoteFile
+func (s *scpHelperDelegate) verify(ctx context.Context, remoteFile, local string) error {
+	session, err := s.newSessionContext(ctx)
+	if err != nil {
+		return err
+	}
+	remote, err := Checksum(s.checksumCmd, remoteFile, session)
+	if err != nil {
+		return err
+	}
+	if remote != local {
+		return &ChecksumMismatchError{Local: local, Remote: remote}
+	}
+	return nil
+}
+
+// copyFile upload fd as dstfile with its permissions, and times when
+// preserving, read through wrap when not nil
+func (s *scpHelperDelegate) copyFile(ctx context.Context, fd *os.File, wrap func(io.Reader) io.Reader, info os.FileInfo, dstfile string) error {
+	if s.skipIdentical && s.compression == None && !s.dryRun {
+		same, err := s.identical(fd, info, dstfile)
+		if err != nil {
+			return err
+		}
+		if same {
+			return ErrSkippedIdentical
+		}
+	}
+
+	var times *fileTimes
+	if s.preserveTimes {
+		times = &fileTimes{mtime: info.ModTime(), atime: info.ModTime()}
+	}
+	var r io.Reader = fd
+	if wrap != nil {
+		r = wrap(fd)
+	}
+	return s.copyContext(ctx, r, info.Size(), dstfile, info.Mode().Perm(), times)
+}
+
+// identical report whether dstfile hold the same content as fd by comparing
+// sha256 sums, or only sizes when the remote has no sha256sum
+func (s *scpHelperDelegate) identical(fd *os.File, info os.FileInfo, dstfile string) (bool, error) {
+	remote, err := s.Stat(dstfile)
+	if err == ErrNotExist {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	if !remote.Mode().IsRegular() || remote.Size() != info.Size() {
+		return false, nil
+	}
+
+	session, err := s.newSession()
+	if err != nil {
+		return false, err
+	}
+	remoteSum, err := Checksum(s.checksumCmd, dstfile, session)
+	if rerr, ok := err.(*RemoteError); ok && rerr.Status == 127 {
+		return true, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	h := sha256.New()
+	if _, err = io.Copy(h, fd); err != nil {
+		return false, err
+	}
+	if _, err = fd.Seek(0, io.SeekStart); err != nil {
+		return false, err
+	}
+	return hex.EncodeToString(h.Sum(nil)) == remoteSum, nil
+}
+
+// MustCopy retry Copy until it succeed. r is rewound before each attempt,
+// non seekable readers are spooled into a temp file first.
+func (s *scpHelperDelegate) MustCopy(r io.Reader, size int64, dstfile string) {
+	rp, err := s.newReplayReader(r)
+	if err != nil {
+		panic(err)
+	}
+	defer rp.Close()
+	ctx, cancel := s.transferContext(context.Background())
+	defer cancel()
+	s.mustDo(ctx, s.attempts(ctx, rp, size, dstfile, func(r io.Reader) error {
+		return s.copyContext(ctx, r, size, dstfile, 0, nil)
+	}))
+}
+
+// TryCopy retry Copy trys times at most, r is rewound like MustCopy
+func (s *scpHelperDelegate) TryCopy(r io.Reader, size int64, dstfile string, trys int) error {
+	rp, err := s.newReplayReader(r)
+	if err != nil {
+		return err
+	}
+	defer rp.Close()
+	ctx, cancel := s.transferContext(context.Background())
+	defer cancel()
+	return s.expired(context.Background(), s.tryDo(ctx, trys, s.attempts(ctx, rp, size, dstfile, func(r io.Reader) error {
+		return s.copyContext(ctx, r, size, dstfile, 0, nil)
+	})))
+}
+
+// CopyReaderAt copy the first size bytes of r to dstfile through its own
+// section reader, so concurrent copies of r do not interfere. r must be safe
+// for concurrent ReadAt calls.
+func (s *scpHelperDelegate) CopyReaderAt(r io.ReaderAt, size int64, dstfile string) error {
+	return s.Copy(io.NewSectionReader(r, 0, size), size, dstfile)
+}
+
+// TryCopyReaderAt like TryCopy without spooling, each attempt read r again
+// from byte zero, or from the resume offset
+func (s *scpHelperDelegate) TryCopyReaderAt(r io.ReaderAt, size int64, dstfile string, trys int) error {
+	rp := &replayReader{rs: io.NewSectionReader(r, 0, size)}
+	ctx, cancel := s.transferContext(context.Background())
+	defer cancel()
+	return s.expired(context.Background(), s.tryDo(ctx, trys, s.attempts(ctx, rp, size, dstfile, func(r io.Reader) error {
+		return s.copyContext(ctx, r, size, dstfile, 0, nil)
+	})))
+}
+
+// attempts return the func run by each retry attempt: it rewind rp and call
+// full, or when resuming append what the remote file still miss. Only a
+// file an earlier attempt started writing is resumed, once its prefix match.
+func (s *scpHelperDelegate) attempts(ctx context.Context, rp *replayReader, size int64, dstfile string, full func(io.Reader) error) func() error {
+	// wrote an earlier attempt sent part of the body into dstfile
+	wrote := false
+	return func() (err error) {
+		defer func() {
+			var partial PartialTransferError
+			if errors.As(err, &partial) && partial.Written > 0 {
+				wrote = true
+			}
+		}()
+		if wrote && s.resume && s.compression == None && !s.atomic {
+			info, err := s.Stat(dstfile)
+			if err == nil && info.Mode().IsRegular() && info.Size() > 0 && info.Size() < size {
+				same, err := s.samePrefix(ctx, rp, info.Size(), dstfile)
+				if err != nil {
+					return err
+				}
+				if same {
+					s.logger.Infof("resume %s from byte %d", dstfile, info.Size())
+					return s.resumeFrom(ctx, rp, info.Size(), size, dstfile)
+				}
+				s.logger.Infof("%s differ from the bytes sent, copy it again", dstfile)
+			}
+		}
+
+		r, err := rp.rewind()
+		if err != nil {
+			return err
+		}
+		return full(r)
+	}
+}
+
+// samePrefix report whether dstfile hold the first n bytes of rp, by sha256,
+// false when the remote has no checksum command
+func (s *scpHelperDelegate) samePrefix(ctx context.Context, rp *replayReader, n int64, dstfile string) (bool, error) {
+	session, err := s.newSessionContext(ctx)
+	if err != nil {
+		return false, err
+	}
+	remote, err := Checksum(s.checksumCmd, dstfile, session)
+	if rerr, ok := err.(*RemoteError); ok && rerr.Status == 127 {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	r, err := rp.rewind()
+	if err != nil {
+		return false, err
+	}
+	h := sha256.New()
+	if _, err = io.CopyN(h, r, n); err != nil {
+		return false, err
+	}
+	return hex.EncodeToString(h.Sum(nil)) == remote, nil
+}
+
+// resumeFrom append bytes from offset to size of rp to dstfile
+func (s *scpHelperDelegate) resumeFrom(ctx context.Context, rp *replayReader, offset, size int64, dstfile string) error {
+	if s.hash != nil {
+		// Sum cover the whole file, the prefix left by the failed attempt too
+		s.hash.Reset()
+		r, err := rp.rewind()
+		if err != nil {
+			return err
+		}
+		if _, err = io.CopyN(s.hash, r, offset); err != nil {
+			return err
+		}
+	}
+	if _, err := rp.rs.Seek(rp.start+offset, io.SeekStart); err != nil {
+		return err
+	}
+	r := io.LimitReader(rp.rs, size-offset)
+	if s.hash != nil {
+		r = io.TeeReader(r, s.hash)
+	}
+	if err := s.appendTo(ctx, r, dstfile); err != nil {
+		return err
+	}
+	if !s.verifyChecksum {
+		return nil
+	}
+
+	r, err := rp.rewind()
+	if err != nil {
+		return err
+	}
+	h := sha256.New()
+	if _, err = io.CopyN(h, r, size); err != nil {
+		return err
+	}
+	return s.verify(ctx, dstfile, hex.EncodeToString(h.Sum(nil)))
+}
+
+// limit draw r from the shared and the local limiters, when set
+func (s *scpHelperDelegate) limit(ctx context.Context, r io.Reader) io.Reader {
+	return s.localLimiter.reader(ctx, s.limiter.reader(ctx, r))
+}
+
+// appendTo append r to the end of dstfile, with sftp or "cat >>"
+func (s *scpHelperDelegate) appendTo(ctx context.Context, r io.Reader, dstfile string) error {
+	r = s.limit(ctx, r)
+	if s.sftp {
+		return s.sftpAppend(ctx, r, dstfile)
+	}
+
+	return s.pipe(ctx, r, "cat >> "+shellQuote(dstfile))
+}
+
+// pipe run cmd over a new session with r as its stdin
+func (s *scpHelperDelegate) pipe(ctx context.Context, r io.Reader, cmd string) error {
+	session, err := s.newSessionContext(ctx)
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+	stop := watchContext(ctx, session)
+	defer stop()
+
+	var stderr bytes.Buffer
+	session.Stdin = r
+	session.Stderr = &stderr
+	return remoteError(session, &stderr, session.Run(cmd))
+}
+
+// replayReader read the same content again on every attempt
+type replayReader struct {
+	rs    io.ReadSeeker
+	start int64
+	tmp   *os.File
+}
+
+// newReplayReader remember where a seekable r stand, or spool r into a temp file
+func (s *scpHelperDelegate) newReplayReader(r io.Reader) (*replayReader, error) {
+	if rs, ok := r.(io.ReadSeeker); ok {
+		start, err := rs.Seek(0, io.SeekCurrent)
+		if err == nil {
+			return &replayReader{rs: rs, start: start}, nil
+		}
+	}
+
+	tmp, err := s.tempFile("spool")
+	if err != nil {
+		return nil, err
+	}
+	p := &replayReader{rs: tmp, tmp: tmp}
+	// removed by defer so a panicking r do not leak it either
+	spooled := false
+	defer func() {
+		if !spooled {
+			p.Close()
+		}
+	}()
+	if _, err = copyBuffer(tmp, r, 0); err != nil {
+		return nil, err
+	}
+	spooled = true
+	return p, nil
+}
+
+func (p *replayReader) rewind() (io.Reader, error) {
+	if _, err := p.rs.Seek(p.start, io.SeekStart); err != nil {
+		return nil, err
+	}
+	return p.rs, nil
+}
+
+// Close remove the spool file if any
+func (p *replayReader) Close() error {
+	if p.tmp == nil {
+		return nil
+	}
+	p.tmp.Close()
+	return os.Remove(p.tmp.Name())
+}
+
+// mustDo like tryDo retrying forever, panic when fn fail permanently
+func (s *scpHelperDelegate) mustDo(ctx context.Context, fn func() error) {
+	if err := s.expired(context.Background(), s.tryDo(ctx, -1, fn)); err != nil && err != ErrSkippedIdentical {
+		panic(err)
+	}
+}
+
+// tryDo call fn until it succeed, retrying trys times at most or forever when
+// trys < 0, both bounded by the max retry duration and ctx. Non retryable
+// errors are returned at once as ErrPermanent.
+func (s *scpHelperDelegate) tryDo(ctx context.Context, trys int, fn func() error) error {
+	retryTimes := 0
+	start := time.Now()
+	var err error
+
+	for {
+		if trys >= 0 && retryTimes > trys {
+			return &ErrTimes{times: retryTimes, err: err}
+		} else if retryTimes > 0 {
+			delay := s.backoff(retryTimes)
+			if !s.noJitter {
+				delay = jitter(delay)
+			}
+			if s.maxRetryDuration > 0 && time.Since(start)+delay > s.maxRetryDuration {
+				s.logger.Warnf("give up after %d attempts in %s: %v", retryTimes, time.Since(start), err)
+				return &ErrTimes{times: retryTimes, err: err}
+			}
+			s.logger.Infof("retry attempt %d in %s after: %v", retryTimes+1, delay, err)
+			s.metrics.OnRetry(retryTimes + 1)
+			timer := time.NewTimer(delay)
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return ctx.Err()
+			case <-timer.C:
+			}
+		}
+		retryTimes++
+		if err = fn(); err == nil || err == ErrSkippedIdentical {
+			return err
+		} else if !RetryableError(err) {
+			s.logger.Warnf("attempt %d fail permanently: %v", retryTimes, err)
+			return &ErrPermanent{Err: err}
+		}
+	}
+}
+
+func (s *scpHelperDelegate) openFile(filename string) (*os.File, os.FileInfo, error) {
+	fd, err := os.Open(filename)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	stat, err := fd.Stat()
+	if err != nil {
+		fd.Close()
+		return nil, nil, err
+	}
+	switch mode := stat.Mode(); {
+	case mode.IsRegular():
+		return fd, stat, nil
+	case mode.IsDir():
+		fd.Close()
+		return nil, nil, fmt.Errorf("%s is a directory, use CopyDir", filename)
+	case mode&os.ModeNamedPipe != 0:
+		// a pipe stat as 0 bytes, spool it to learn its size
+		defer fd.Close()
+		return s.spoolPipe(fd, stat)
+	}
+	fd.Close()
+	return nil, nil, fmt.Errorf("%s is not a regular file, open it and use Copy with an explicit size", filename)
+}
+
+// spoolPipe drain pipe into an unlinked temp file, which has a size and can
+// be replayed on retry
+func (s *scpHelperDelegate) spoolPipe(pipe *os.File, info os.FileInfo) (*os.File, os.FileInfo, error) {
+	tmp, err := s.tempFile("pipe")
+	if err != nil {
+		return nil, nil, err
+	}
+	os.Remove(tmp.Name())
+
+	if _, err = copyBuffer(tmp, pipe, 0); err == nil {
+		err = tmp.Chmod(info.Mode().Perm())
+	}
+	if err == nil {
+		_, err = tmp.Seek(0, io.SeekStart)
+	}
+	var stat os.FileInfo
+	if err == nil {
+		stat, err = tmp.Stat()
+	}
+	if err != nil {
+		tmp.Close()
+		return nil, nil, err
+	}
+	return tmp, stat, nil
+}
+
+func (s *scpHelperDelegate) CopyPath(srcfile, dstfile string) error {
+	return s.CopyPathContext(context.Background(), srcfile, dstfile)
+}
+
+func (s *scpHelperDelegate) CopyPathContext(ctx context.Context, srcfile, dstfile string) error {
+	fd, info, err := s.openFile(srcfile)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+	return s.copyFile(ctx, fd, nil, info, dstfile)
+}
+
+// CopyPathWithReader copy srcfile like CopyPath, reading it through the
+// reader returned by wrap, e.g. a progress bar of the caller. The wrapped
+// reader is read as is, use it without SetProgressFunc.
+func (s *scpHelperDelegate) CopyPathWithReader(srcfile string, wrap func(io.Reader) io.Reader, dstfile string) error {
+	fd, info, err := s.openFile(srcfile)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+	return s.copyFile(context.Background(), fd, wrap, info, dstfile)
+}
+
+// CopyPathAs copy srcfile into the remote directory dstdir as dstname, an
+// empty dstname keep the base name of srcfile
+func (s *scpHelperDelegate) CopyPathAs(srcfile, dstdir, dstname string) error {
+	if dstname == "" {
+		dstname = filepath.Base(srcfile)
+	}
+	return s.CopyPath(srcfile, filepath.Join(dstdir, dstname))
+}
+
+func (s *scpHelperDelegate) MustCopyPath(srcfile, dstfile string) {
+	fd, info, err := s.openFile(srcfile)
+	if err != nil {
+		panic(err)
+	}
+	defer fd.Close()
+	ctx, cancel := s.transferContext(context.Background())
+	defer cancel()
+	s.mustDo(ctx, s.attempts(ctx, &replayReader{rs: fd}, info.Size(), dstfile, func(io.Reader) error {
+		return s.copyFile(ctx, fd, nil, info, dstfile)
+	}))
+}
+
+func (s *scpHelperDelegate) TryCopyPath(srcfile, dstfile string, trys int) error {
+	fd, info, err := s.openFile(srcfile)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+	ctx, cancel := s.transferContext(context.Background())
+	defer cancel()
+	return s.expired(context.Background(), s.tryDo(ctx, trys, s.attempts(ctx, &replayReader{rs: fd}, info.Size(), dstfile, func(io.Reader) error {
+		return s.copyFile(ctx, fd, nil, info, dstfile)
+	})))
+}
+
+// openSink start the scp sink receiving into dstdir, or its sftp emulation
+func (s *scpHelperDelegate) openSink(recursive bool, dstdir string) (recordSink, error) {
+	if s.dryRun {
+		return s.dryRunSink(dstdir), nil
+	}
+	if err := s.makeParents(context.Background(), dstdir); err != nil {
+		return nil, err
+	}
+	if err := s.hook(context.Background(), s.preCommand); err != nil {
+		return nil, err
+	}
+	if s.sftp {
+		return s.openSftpSink(context.Background(), dstdir)
+	}
+
+	session, err := s.newSession()
+	if err != nil {
+		return nil, err
+	}
+
+	flags := s.scpFlags()
+	if s.preserveTimes {
+		flags += " -p"
+	}
+	if recursive {
+		flags += " -r"
+	}
+	snk, err := startSink(session, fmt.Sprintf("scp %s -t %s", quoteFields(flags), shellQuote(dstdir)))
+	if err != nil {
+		session.Close()
+		return nil, err
+	}
+	snk.progress = s.progress
+	snk.wire = s.wireLog
+	snk.bufferSize = s.bufferSize
+	return snk, nil
+}
+
+// CopyDir copy the whole srcdir tree into dstdir like "scp -r"
+func (s *scpHelperDelegate) CopyDir(srcdir, dstdir string) error {
+	info, err := os.Stat(srcdir)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return &ErrFile{Path: srcdir, Err: fmt.Errorf("not a directory")}
+	}
+
+	snk, err := s.openSink(true, dstdir)
+	if err != nil {
+		return err
+	}
+	defer snk.close()
+	t := &treeWalker{sink: snk, limit: s.limit, follow: s.followSymlinks, keepGoing: s.continueOnError, preserve: s.preserveTimes}
+	if err = t.walk(srcdir, info, nil); err != nil {
+		return err
+	}
+	if err = snk.wait(); err != nil {
+		return err
+	}
+	if len(t.errs) > 0 {
+		return t.errs
+	}
+	return s.hook(context.Background(), s.postCommand)
+}
+
+// CopyFiles copy every srcfiles into dstdir over a single session
+func (s *scpHelperDelegate) CopyFiles(srcfiles []string, dstdir string) error {
+	snk, err := s.openSink(false, dstdir)
+	if err != nil {
+		return err
+	}
+	defer snk.close()
+	t := &treeWalker{sink: snk, limit: s.limit, follow: true, keepGoing: s.continueOnError, preserve: s.preserveTimes}
+
+	var sent []string
+	for _, name := range srcfiles {
+		failed := len(t.errs)
+		info, err := os.Stat(name)
+		if err != nil {
+			err = t.fail(name, err)
+		} else if !info.Mode().IsRegular() {
+			err = t.fail(name, fmt.Errorf("not a regular file"))
+		} else {
+			err = t.file(name, info)
+		}
+
+		if err != nil {
+			ferr, ok := err.(*ErrFile)
+			if !ok {
+				ferr = &ErrFile{Path: name, Err: err}
+			}
+			return &ErrPartial{Sent: sent, Failed: ferr}
+		}
+		if len(t.errs) == failed {
+			sent = append(sent, name)
+		}
+	}
+
+	if err = snk.wait(); err != nil {
+		return err
+	}
+	if len(t.errs) > 0 {
+		return t.errs
+	}
+	return s.hook(context.Background(), s.postCommand)
+}
+
+// CopyGlob copy the local files matching pattern into dstdir like CopyFiles,
+// no match is an error
+func (s *scpHelperDelegate) CopyGlob(pattern, dstdir string) error {
+	matches, err := filepath.Glob(pattern)
+	if err != nil {
+		return err
+	}
+	if len(matches) == 0 {
+		return fmt.Errorf("no files matched %s", pattern)
+	}
+	return s.CopyFiles(matches, dstdir)
+}
+
+// treeWalker send a local directory tree as D/C/E records
+type treeWalker struct {
+	sink      recordSink
+	limit     func(context.Context, io.Reader) io.Reader
+	follow    bool
+	keepGoing bool
+	preserve  bool
+	errs      ErrFiles
+}
+
+// times send a T record for info when preserving times
+func (t *treeWalker) times(info os.FileInfo) error {
+	if !t.preserve {
+		return nil
+	}
+	return t.sink.times(&fileTimes{mtime: info.ModTime(), atime: info.ModTime()})
+}
+
+func (t *treeWalker) walk(dir string, info os.FileInfo, parents []os.FileInfo) error {
+	if err := t.times(info); err != nil {
+		return t.sinkFail(dir, err)
+	}
+	if err := t.sink.dir(info.Mode().Perm(), filepath.Base(dir)); err != nil {
+		return t.sinkFail(dir, err)
+	}
+
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		if err = t.fail(dir, err); err != nil {
+			return err
+		}
+	}
+	parents = append(parents, info)
+
+	for _, fi := range infos {
+		name := filepath.Join(dir, fi.Name())
+		if fi.Mode()&os.ModeSymlink != 0 {
+			if !t.follow {
+				continue
+			}
+			if fi, err = os.Stat(name); err != nil {
+				if err = t.fail(name, err); err != nil {
+					return err
+				}
+				continue
+			}
+		}
+
+		switch {
+		case fi.IsDir():
+			err = t.walkChild(name, fi, parents)
+		case fi.Mode().IsRegular():
+			err = t.file(name, fi)
+		default:
+			err = t.fail(name, fmt.Errorf("not a regular file"))
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return t.sink.end()
+}
+
+func (t *treeWalker) walkChild(dir string, info os.FileInfo, parents []os.FileInfo) error {
+	for _, p := range parents {
+		if os.SameFile(p, info) {
+			return t.fail(dir, fmt.Errorf("symlink loop"))
+		}
+	}
+	return t.walk(dir, info, parents)
+}
+
+func (t *treeWalker) file(name string, info os.FileInfo) error {
+	fd, err := os.Open(name)
+	if err != nil {
+		return t.fail(name, err)
+	}
+	defer fd.Close()
+
+	if err = t.times(info); err != nil {
+		return t.sinkFail(name, err)
+	}
+	if err = t.sink.file(info.Mode().Perm(), info.Size(), info.Name(), t.limit(context.Background(), fd)); err != nil {
+		return t.sinkFail(name, err)
+	}
+	return nil
+}
+
+// fail record err for name, return non-nil when the walk must abort
+func (t *treeWalker) fail(name string, err error) error {
+	ferr := &ErrFile{Path: name, Err: err}
+	if ack, ok := err.(*ErrAck); !t.keepGoing || (ok && ack.Fatal) {
+		return ferr
+	}
+	t.errs = append(t.errs, ferr)
+	return nil
+}
+
+// sinkFail like fail, but transport errors always abort
+func (t *treeWalker) sinkFail(name string, err error) error {
+	if _, ok := err.(*ErrAck); !ok {
+		return err
+	}
+	return t.fail(name, err)
+}
+
+func (s *scpHelperDelegate) Fetch(srcfile string, w io.Writer) (int64, error) {
+	return s.fetch(srcfile, func(os.FileMode, int64, string, *fileTimes) (io.Writer, error) {
+		return w, nil
+	})
+}
+
+// fetch download srcfile into the writer returned by open, through scp or
+// sftp, asking for the remote times when preserving
+func (s *scpHelperDelegate) fetch(srcfile string, open func(os.FileMode, int64, string, *fileTimes) (io.Writer, error)) (int64, error) {
+	if s.sftp {
+		return s.sftpFetch(srcfile, open)
+	}
+
+	session, err := s.newSession()
+	if err != nil {
+		return 0, err
+	}
+	flags := s.scpFlags()
+	if s.preserveTimes {
+		flags += " -p"
+	}
+	return fetch(srcfile, flags, open, session)
+}
+
+// Stat query remote file info, return ErrNotExist when it is absent
+func (s *scpHelperDelegate) Stat(remotePath string) (os.FileInfo, error) {
+	if s.sftp {
+		return s.sftpStat(remotePath)
+	}
+
+	session, err := s.newSession()
+	if err != nil {
+		return nil, err
+	}
+	return Stat(remotePath, session)
+}
+
+// FetchPath download srcfile into the local dstfile, with the remote times
+// when preserving. Without them, or when they are implausible, dstfile keep
+// the time it was written.
+func (s *scpHelperDelegate) FetchPath(srcfile, dstfile string) error {
+	var fd *os.File
+	var times *fileTimes
+	_, err := s.fetch(srcfile, func(mode os.FileMode, size int64, name string, t *fileTimes) (io.Writer, error) {
+		var err error
+		times = t
+		fd, err = os.OpenFile(dstfile, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+		return fd, err
+	})
+	if fd != nil {
+		if cerr := fd.Close(); err == nil {
+			err = cerr
+		}
+	}
+	if err != nil || times == nil {
+		return err
+	}
+	if !plausibleTime(times.mtime) || !plausibleTime(times.atime) {
+		s.logger.Warnf("ignore implausible times of %s: mtime %s, atime %s", srcfile, times.mtime, times.atime)
+		return nil
+	}
+	return os.Chtimes(dstfile, times.atime, times.mtime)
+}
+
+// plausibleTime t is after the epoch and at most a day in the future, more
+// likely a broken remote clock or record than a real time
+func plausibleTime(t time.Time) bool {
+	return t.Unix() > 0 && t.Before(time.Now().Add(24*time.Hour))
+}
+
+// Close release the cached ssh client, next copy redial. Helpers from a Pool
+// should be given back with Pool.Put instead.
+func (s *scpHelperDelegate) Close() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.client == nil || s.external {
+		return nil
+	}
+	err := s.client.Close()
+	s.client = nil
+	return err
+}
+
+// SetLimitKB same as SetLimitKBps, negative values are ignored.
+//
+// Deprecated: the unit is ambiguous, use SetLimitKbps or SetLimitKBps.
+func (s *scpHelperDelegate) SetLimitKB(kbs int) {
+	s.SetLimitKBps(kbs)
+}
+
+// SetLimitKbps pass kbps kilobits/s to scp -l, zero remove the limit
+func (s *scpHelperDelegate) SetLimitKbps(kbps int) error {
+	if kbps < 0 {
+		return fmt.Errorf("negative bandwidth limit %d", kbps)
+	}
+	if kbps == 0 {
+		s.flags = ""
+	} else {
+		s.flags = fmt.Sprintf("-l %d", kbps)
+	}
+	return nil
+}
+
+// SetLimitKBps limit scp to kBps kilobytes/s, zero remove the limit
+func (s *scpHelperDelegate) SetLimitKBps(kBps int) error {
+	if kBps < 0 {
+		return fmt.Errorf("negative bandwidth limit %d", kBps)
+	}
+	return s.SetLimitKbps(kBps * 8)
+}
+
+func (s *scpHelperDelegate) SetGzipEnable(enable bool) {
+	if enable {
+		s.SetCompression(Gzip, 0)
+	} else {
+		s.SetCompression(None, 0)
+	}
+}
+
+// SetCompression compress contents with algo at level before upload, level 0
+// pick the algorithm default
+func (s *scpHelperDelegate) SetCompression(algo Compression, level int) error {
+	if err := algo.checkLevel(level); err != nil {
+		return err
+	}
+	s.compression = algo
+	s.level = level
+	return nil
+}
+
+func (s *scpHelperDelegate) SetFollowSymlinks(follow bool) {
+	s.followSymlinks = follow
+}
+
+func (s *scpHelperDelegate) SetContinueOnError(enable bool) {
+	s.continueOnError = enable
+}
+
+func (s *scpHelperDelegate) SetPreserveTimes(enable bool) {
+	s.preserveTimes = enable
+}
+
+// SetProgressFunc fn is called every 64KB sent and once more when a file is done,
+// total is the compressed size when compression is enabled. Without fn the
+// reader given to Copy is read as is, so callers may wrap it with their own
+// progress reader.
+func (s *scpHelperDelegate) SetProgressFunc(fn func(copied, total int64)) {
+	s.progress = fn
+}
+
+// SetBackoff strategy used between MustCopy/TryCopy attempts, nil restore DefaultBackoff
+func (s *scpHelperDelegate) SetBackoff(strategy BackoffFunc) {
+	if strategy == nil {
+		strategy = DefaultBackoff
+	}
+	s.backoff = strategy
+}
+
+// SetMaxRetryDuration stop retrying once the next attempt would start after d,
+// MustCopy then panic with ErrTimes. Zero mean no limit.
+func (s *scpHelperDelegate) SetMaxRetryDuration(d time.Duration) {
+	s.maxRetryDuration = d
+}
+
+// SetEnv export env to the remote scp process, names refused by the remote
+// sshd AcceptEnv are skipped with a warning, see SetEnvStrict
+func (s *scpHelperDelegate) SetEnv(env map[string]string) {
+	s.env = env
+}
+
+// SetSkipIfIdentical make CopyPath return ErrSkippedIdentical without copying
+// when the remote file already match by sha256, ignored with compression
+func (s *scpHelperDelegate) SetSkipIfIdentical(enable bool) {
+	s.skipIdentical = enable
+}
+
+// SetVerifyChecksum compare the sha256 of bytes sent with the remote file sum
+// after each copy, a difference is reported as ChecksumMismatchError
+func (s *scpHelperDelegate) SetVerifyChecksum(enable bool) {
+	s.verifyChecksum = enable
+}
+
+// SetChecksumCommand remote command printing the sha256 of a file, default
+// "sha256sum", e.g. "shasum -a 256" on BSD
+func (s *scpHelperDelegate) SetChecksumCommand(cmd string) {
+	s.checksumCmd = cmd
+}
+
+// SetMode pin the remote file mode, by default CopyPath keep the source
+// permissions and Copy use 0777. Zero restore the default.
+func (s *scpHelperDelegate) SetMode(mode os.FileMode) {
+	s.mode = mode.Perm()
+}
+
+// SetAtomic upload to a temp file next to dstfile and rename it into place
+// only once the upload succeed, the temp file is removed on failure
+func (s *scpHelperDelegate) SetAtomic(enable bool) {
+	s.atomic = enable
+}
+
+// SetLogger receive dial, retry and reconnect events, nil discard them
+func (s *scpHelperDelegate) SetLogger(logger Logger) {
+	if logger == nil {
+		logger = nopLogger{}
+	}
+	s.logger = logger
+}
+
+// SetMetrics receive transfer and retry hooks, nil disable them
+func (s *scpHelperDelegate) SetMetrics(metrics Metrics) {
+	if metrics == nil {
+		metrics = nopMetrics{}
+	}
+	s.metrics = metrics
+}
+
+// SetResume make retries of MustCopy/TryCopy and their Path variants append
+// only the bytes missing from a partial remote file, instead of sending it
+// again. Only a file left by an earlier failed attempt of the same call is
+// resumed, once its sha256 match the bytes sent. Ignored with compression or
+// atomic uploads.
+func (s *scpHelperDelegate) SetResume(enable bool) {
+	s.resume = enable
+}
+
+// SetRateLimiter draw every transfer of this helper from limiter, the same
+// limiter can be shared by many helpers to cap their total bandwidth.
+// Nil remove the limit.
+func (s *scpHelperDelegate) SetRateLimiter(limiter *RateLimiter) {
+	s.limiter = limiter
+}
+
+// SetKeepAlive probe the connection every interval while the helper is idle,
+// a dead connection is closed and redialed by the next copy. Zero disable it,
+// helpers built from an external client never probe it.
+func (s *scpHelperDelegate) SetKeepAlive(interval time.Duration) {
+	s.keepAlive = interval
+}
+
+// SetDryRun make Copy, CopyDir, CopyFiles and their variants only log the
+// records they would send through the Logger and progress hooks, without
+// opening any session. Enabling it reset DryRunBytes.
+func (s *scpHelperDelegate) SetDryRun(enable bool) {
+	s.dryRun = enable
+	if enable {
+		atomic.StoreInt64(&s.dryRunBytes, 0)
+	}
+}
+
+// DryRunBytes total size that would have been sent since SetDryRun(true)
+func (s *scpHelperDelegate) DryRunBytes() int64 {
+	return atomic.LoadInt64(&s.dryRunBytes)
+}
+
+// SetMkdirParents run mkdir -p on the destination directory before each
+// transfer, so missing parents are created instead of failing scp -t
+func (s *scpHelperDelegate) SetMkdirParents(enable bool) {
+	s.mkdirParents = enable
+}
+
+// SetMkdirMode mode of directories created by SetMkdirParents, default 0755
+func (s *scpHelperDelegate) SetMkdirMode(mode os.FileMode) {
+	s.mkdirMode = mode.Perm()
+}
+
+// SetGzipSuffix appended to the remote name of compressed uploads instead of
+// ".gz" (or ".zst"), empty keep the name unchanged
+func (s *scpHelperDelegate) SetGzipSuffix(suffix string) {
+	s.suffix = suffix
+	s.suffixSet = true
+}
+
+// SetGzipTransparent send compressed data but store it decompressed under
+// the original name, by piping it into the remote gzip -d (or zstd -d)
+// instead of scp. The remote checksum is compared with the plain content.
+func (s *scpHelperDelegate) SetGzipTransparent(enable bool) {
+	s.transparent = enable
+}
+
+// SetBufferSize size of the buffer each file body is copied through, a
+// larger one only save read and write calls. On high latency links the ssh
+// channel window, not this buffer, bound the throughput. Buffers are pooled
+// per size across transfers, zero or less restore the default of 32KB.
+func (s *scpHelperDelegate) SetBufferSize(size int) {
+	if size < 0 {
+		size = 0
+	}
+	s.bufferSize = size
+}
+
+// SetTransferTimeout give up a single file transfer after d, retries of
+// MustCopy/TryCopy and their Path variants included, closing its session and
+// returning TimeoutError. CopyDir and CopyFiles are not bounded. Zero disable it.
+func (s *scpHelperDelegate) SetTransferTimeout(d time.Duration) {
+	s.transferTimeout = d
+}
+
+// SetRemoteChmod run chmod mode after each single file upload, unlike SetMode it is
+// not subject to the remote umask. Zero disable it.
+func (s *scpHelperDelegate) SetRemoteChmod(mode os.FileMode) {
+	s.chmod = mode.Perm()
+}
+
+// SetRemoteChown run chown user:group after each single file upload, either may be
+// empty to keep it, the connection need enough rights, usually root
+func (s *scpHelperDelegate) SetRemoteChown(user, group string) {
+	switch {
+	case user != "" && group != "":
+		s.chown = user + ":" + group
+	case group != "":
+		s.chown = ":" + group
+	default:
+		s.chown = user
+	}
+}
+
+// SetPreCommand run cmd on the remote before each transfer, a failure abort
+// the transfer with ErrCommand. Empty disable it.
+func (s *scpHelperDelegate) SetPreCommand(cmd string) {
+	s.preCommand = cmd
+}
+
+// SetPostCommand run cmd on the remote after each successful transfer, e.g.
+// to restart a service, a failure is returned as ErrCommand. Empty disable it.
+func (s *scpHelperDelegate) SetPostCommand(cmd string) {
+	s.postCommand = cmd
+}
+
+// SetGzipMinRatio send a file plain, without suffix, when compression save
+// less than ratio of its size, default 0.05. Zero always compress.
+func (s *scpHelperDelegate) SetGzipMinRatio(ratio float64) {
+	if ratio < 0 {
+		ratio = 0
+	}
+	s.minRatio = ratio
+}
+
+// SetHash feed h with the bytes sent of each single file upload, after
+// compression, h is Reset when a transfer start. Nil disable it.
+func (s *scpHelperDelegate) SetHash(h hash.Hash) {
+	s.hash = h
+}
+
+// Sum sum of the bytes sent by the last upload, nil without SetHash
+func (s *scpHelperDelegate) Sum() []byte {
+	if s.hash == nil {
+		return nil
+	}
+	return s.hash.Sum(nil)
+}
+
+// SetJitter randomize each retry delay between half and all of the backoff,
+// default on. Disable it for deterministic delays in tests.
+func (s *scpHelperDelegate) SetJitter(enable bool) {
+	s.noJitter = !enable
+}
+
+// SetWireLog trace to w the scp records sent, as "> ", and the status bytes
+// received, as "< ", file bodies excepted. Nil disable it.
+func (s *scpHelperDelegate) SetWireLog(w io.Writer) {
+	s.wireLog = w
+}
+
+// SetGzipMinSize compress only files larger than size bytes, smaller ones are
+// sent plain under their own name. Zero compress every file.
+func (s *scpHelperDelegate) SetGzipMinSize(size int64) {
+	if size < 0 {
+		size = 0
+	}
+	s.minSize = size
+}
+
+// SetEnvStrict fail the transfer when the remote refuse a SetEnv variable,
+// by default it is skipped like the OpenSSH client does
+func (s *scpHelperDelegate) SetEnvStrict(strict bool) {
+	s.envStrict = strict
+}
+
+// SetMaxFileSize make single file uploads larger than size fail with
+// ErrFileTooLarge before anything is sent. Zero mean no limit.
+func (s *scpHelperDelegate) SetMaxFileSize(size int64) {
+	if size < 0 {
+		size = 0
+	}
+	s.maxFileSize = size
+}
+
+// SetCheckDiskSpace run df in the remote directory before each single file
+// upload, and fail with ErrInsufficientSpace when it can not hold the file
+// plus the margin
+func (s *scpHelperDelegate) SetCheckDiskSpace(enable bool) {
+	s.checkDiskSpace = enable
+}
+
+// SetDiskSpaceMargin bytes that must stay free beyond the file when checking
+// disk space, default 16MB
+func (s *scpHelperDelegate) SetDiskSpaceMargin(margin int64) {
+	if margin < 0 {
+		margin = 0
+	}
+	s.spaceMargin = margin
+}
+
+// SetTempDir directory of the local temp files spooling streams and pipes,
+// empty use os.TempDir()
+func (s *scpHelperDelegate) SetTempDir(dir string) {
+	s.tempDir = dir
+}
+
+// SetTempPrefix start the name of local temp files, empty restore "scp-"
+func (s *scpHelperDelegate) SetTempPrefix(prefix string) {
+	if prefix == "" {
+		prefix = defaultTempPrefix
+	}
+	s.tempPrefix = prefix
+}
+
+// SetRemoteTempDir upload atomic temp files into dir instead of beside the
+// target, dir must exist on the same filesystem or the rename is a copy.
+// Empty restore the default.
+func (s *scpHelperDelegate) SetRemoteTempDir(dir string) {
+	s.remoteTempDir = dir
+}
+
+// SetAppend append single file uploads to the remote file with cat >>, or
+// sftp, instead of replacing it. The bytes are sent plain, compression,
+// checksum verification and atomic rename do not apply, so a failed upload
+// may leave part of the bytes appended.
+func (s *scpHelperDelegate) SetAppend(enable bool) {
+	s.append = enable
+}
+
+// SetLocalLimit cap the bytes fed to the transfers of this helper at
+// bytesPerSec, whatever the remote scp do with -l, and on top of
+// SetRateLimiter. Zero or less remove it.
+func (s *scpHelperDelegate) SetLocalLimit(bytesPerSec int) {
+	if bytesPerSec <= 0 {
+		s.localLimiter = nil
+		return
+	}
+	s.localLimiter = NewRateLimiter(bytesPerSec)
+}
+
+// SetOnReconnect call fn with the session error that made the helper, or its
+// pooled client, drop the cached connection and dial again. Frequent calls
+// tell a flaky link. fn run once the redial is done, without any lock held.
+func (s *scpHelperDelegate) SetOnReconnect(fn func(error)) {
+	s.onReconnect = fn
 }
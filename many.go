@@ -0,0 +1,107 @@
+package scp
+
+import (
+	"context"
+	"io"
+	"sync"
+)
+
+// CopyResult outcome of one host of CopyManyWith, Index is its position in
+// dialers, Addr alone may be shared by several dialers
+type CopyResult struct {
+	Index int
+	Addr  string
+	Err   error
+}
+
+// CopyManyOptions tune CopyManyWith
+type CopyManyOptions struct {
+	// Concurrency at most that many hosts at a time, 0 mean all at once
+	Concurrency int
+	// PerBastion at most that many hosts at a time behind the same first
+	// Jump host, bounded by its MaxSessions, 0 mean no limit
+	PerBastion int
+	// Results receive each host result as it complete, then it is closed.
+	// It must be drained or buffered, else the transfers block on it.
+	Results chan<- CopyResult
+}
+
+// CopyMany upload size bytes of src to dstfile on every host of dialers, at
+// most concurrency hosts at a time (0 mean all at once), and return the
+// result of each host at the index of its dialer. src must be safe for
+// concurrent ReadAt calls. Hosts not started when ctx is done get ctx.Err().
+func CopyMany(ctx context.Context, dialers []Dialer, src io.ReaderAt, size int64, dstfile string, concurrency int) []error {
+	return CopyManyWith(ctx, dialers, src, size, dstfile, CopyManyOptions{Concurrency: concurrency})
+}
+
+// CopyManyWith like CopyMany with more options
+func CopyManyWith(ctx context.Context, dialers []Dialer, src io.ReaderAt, size int64, dstfile string, opts CopyManyOptions) []error {
+	concurrency := opts.Concurrency
+	if concurrency <= 0 || concurrency > len(dialers) {
+		concurrency = len(dialers)
+	}
+	sem := make(chan struct{}, concurrency)
+	bastions := make(map[string]chan struct{})
+
+	errs := make([]error, len(dialers))
+	var wg sync.WaitGroup
+	for i := range dialers {
+		// acquire the bastion slot before the global one, so hosts waiting
+		// on a busy bastion do not hold global slots
+		var sems []chan struct{}
+		if key := bastionKey(&dialers[i]); key != "" && opts.PerBastion > 0 {
+			if bastions[key] == nil {
+				bastions[key] = make(chan struct{}, opts.PerBastion)
+			}
+			sems = append(sems, bastions[key])
+		}
+		sems = append(sems, sem)
+
+		wg.Add(1)
+		go func(i int, sems []chan struct{}) {
+			defer wg.Done()
+			defer func() {
+				if opts.Results != nil {
+					opts.Results <- CopyResult{Index: i, Addr: dialers[i].SSHAddr, Err: errs[i]}
+				}
+			}()
+
+			for n, s := range sems {
+				select {
+				case s <- struct{}{}:
+				case <-ctx.Done():
+					for _, held := range sems[:n] {
+						<-held
+					}
+					errs[i] = ctx.Err()
+					return
+				}
+			}
+			defer func() {
+				for _, s := range sems {
+					<-s
+				}
+			}()
+			errs[i] = copyOne(ctx, &dialers[i], src, size, dstfile)
+		}(i, sems)
+	}
+	wg.Wait()
+	if opts.Results != nil {
+		close(opts.Results)
+	}
+	return errs
+}
+
+// bastionKey identify the first jump host of dialer, empty without Jump
+func bastionKey(dialer *Dialer) string {
+	if len(dialer.Jump) == 0 {
+		return ""
+	}
+	return dialer.Jump[0].SSHUser + "@" + dialer.Jump[0].SSHAddr
+}
+
+func copyOne(ctx context.Context, dialer *Dialer, src io.ReaderAt, size int64, dstfile string) error {
+	h := NewHelper(dialer)
+	defer h.Close()
+	return h.CopyContext(ctx, io.NewSectionReader(src, 0, size), size, dstfile)
+}
@@ -0,0 +1,18 @@
+package scp
+
+import "time"
+
+// Metrics hooks called around transfers, e.g. to feed prometheus collectors
+type Metrics interface {
+	OnTransferStart()
+	// OnTransferEnd bytes is the size sent on the wire, 0 when err != nil
+	OnTransferEnd(bytes int64, dur time.Duration, err error)
+	OnRetry(attempt int)
+}
+
+// nopMetrics default Metrics doing nothing
+type nopMetrics struct{}
+
+func (nopMetrics) OnTransferStart()                                        {}
+func (nopMetrics) OnTransferEnd(bytes int64, dur time.Duration, err error) {}
+func (nopMetrics) OnRetry(attempt int)                                     {}
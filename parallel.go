@@ -0,0 +1,163 @@
+package scp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// mkdirBatch directories created by a single mkdir -p command
+const mkdirBatch = 100
+
+// maxParallelWorkers workers of CopyDirParallel, under the MaxSessions 10 of
+// a default sshd as each worker hold a session
+const maxParallelWorkers = 8
+
+// CopyDirParallel copy the tree of srcdir into dstdir with workers uploads
+// at a time, each over its own session. Unlike CopyDir, dstdir become the
+// copy of srcdir whether it exist or not. Directories are created with
+// mkdir -p before any file, failed files are returned as ErrFiles once every
+// other file was tried. workers is clamped to [1, 8]. The progress func,
+// Metrics and wire log are called from every worker at once, SetHash is
+// rejected as files would mix into one sum.
+func (s *scpHelperDelegate) CopyDirParallel(srcdir, dstdir string, workers int) error {
+	if s.hash != nil {
+		return errors.New("CopyDirParallel do not support SetHash, it sum a single file")
+	}
+	info, err := os.Stat(srcdir)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return &ErrFile{Path: srcdir, Err: fmt.Errorf("not a directory")}
+	}
+	if workers <= 0 {
+		workers = 1
+	} else if workers > maxParallelWorkers {
+		workers = maxParallelWorkers
+	}
+
+	dirs, files, errs := s.listTree(srcdir)
+	ctx := context.Background()
+	if err = s.hook(ctx, s.preCommand); err != nil {
+		return err
+	}
+	if err = s.mkdirs(ctx, dstdir, dirs); err != nil {
+		return err
+	}
+
+	var lock sync.Mutex
+	jobs := make(chan string)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for rel := range jobs {
+				if err := s.sendFile(ctx, filepath.Join(srcdir, rel), filepath.Join(dstdir, rel)); err != nil {
+					lock.Lock()
+					errs = append(errs, &ErrFile{Path: filepath.Join(srcdir, rel), Err: err})
+					lock.Unlock()
+				}
+			}
+		}()
+	}
+	for _, rel := range files {
+		jobs <- rel
+	}
+	close(jobs)
+	wg.Wait()
+
+	if len(errs) > 0 {
+		sort.Slice(errs, func(i, j int) bool { return errs[i].Path < errs[j].Path })
+		return errs
+	}
+	return s.hook(ctx, s.postCommand)
+}
+
+// listTree list the directories and regular files under root, relative to
+// it, parents before children. Unreadable entries are returned as errs.
+func (s *scpHelperDelegate) listTree(root string) (dirs, files []string, errs ErrFiles) {
+	filepath.Walk(root, func(name string, info os.FileInfo, err error) error {
+		if err != nil {
+			errs = append(errs, &ErrFile{Path: name, Err: err})
+			return nil
+		}
+		rel, _ := filepath.Rel(root, name)
+		if info.Mode()&os.ModeSymlink != 0 {
+			if !s.followSymlinks {
+				return nil
+			}
+			if info, err = os.Stat(name); err != nil {
+				errs = append(errs, &ErrFile{Path: name, Err: err})
+				return nil
+			}
+			if info.IsDir() {
+				// Walk do not descend into linked directories
+				errs = append(errs, &ErrFile{Path: name, Err: fmt.Errorf("symlinked directory not supported")})
+				return nil
+			}
+		}
+
+		switch {
+		case info.IsDir():
+			dirs = append(dirs, rel)
+		case info.Mode().IsRegular():
+			files = append(files, rel)
+		default:
+			errs = append(errs, &ErrFile{Path: name, Err: fmt.Errorf("not a regular file")})
+		}
+		return nil
+	})
+	return dirs, files, errs
+}
+
+// mkdirs create dstdir and dirs under it, mkdirBatch at a time
+func (s *scpHelperDelegate) mkdirs(ctx context.Context, dstdir string, dirs []string) error {
+	if s.dryRun {
+		for _, dir := range dirs {
+			s.logger.Infof("dry-run: mkdir -p %s", filepath.Join(dstdir, dir))
+		}
+		return nil
+	}
+	for len(dirs) > 0 {
+		n := len(dirs)
+		if n > mkdirBatch {
+			n = mkdirBatch
+		}
+		paths := make([]string, n)
+		for i, dir := range dirs[:n] {
+			paths[i] = shellQuote(filepath.Join(dstdir, dir))
+		}
+		if err := s.run(ctx, "mkdir -p -- "+strings.Join(paths, " ")); err != nil {
+			return err
+		}
+		dirs = dirs[n:]
+	}
+	return nil
+}
+
+// sendFile upload the local srcfile as dstfile with its mode, and times
+// when preserving, bounded by the transfer timeout but without the pre and
+// post commands
+func (s *scpHelperDelegate) sendFile(ctx context.Context, srcfile, dstfile string) error {
+	fd, info, err := s.openFile(srcfile)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+
+	var times *fileTimes
+	if s.preserveTimes {
+		times = &fileTimes{mtime: info.ModTime(), atime: info.ModTime()}
+	}
+	tctx, cancel := s.transferContext(ctx)
+	defer cancel()
+	err = s.send(tctx, fd, info.Size(), filepath.Dir(dstfile), filepath.Base(dstfile), info.Mode().Perm(), times)
+	return s.expired(ctx, err)
+}
@@ -0,0 +1,127 @@
+package scp
+
+import (
+	"os"
+	"os/exec"
+	"testing"
+	"time"
+)
+
+func TestParseDf(t *testing.T) {
+	tests := []struct {
+		out  string
+		want int64
+		ok   bool
+	}{
+		{" Avail\n 123456789\n", 123456789, true},
+		{"Filesystem 1024-blocks Used Available Capacity Mounted on\n/dev/sda1 1000 400 600 40% /\n", 600 * 1024, true},
+		{"Filesystem 1024-blocks Used Available Capacity Mounted on\n/dev/mapper/a-very-long-name 1000 400 600 40% /srv\n", 600 * 1024, true},
+		{"", 0, false},
+		{"Avail\nunknown\n", 0, false},
+		{"a b c\n", 0, false},
+	}
+	for _, tt := range tests {
+		got, err := parseDf(tt.out)
+		if tt.ok && (err != nil || got != tt.want) {
+			t.Errorf("%q: got %d %v, want %d", tt.out, got, err, tt.want)
+		}
+		if !tt.ok && err == nil {
+			t.Errorf("%q: got %d, want an error", tt.out, got)
+		}
+	}
+}
+
+func TestParseStat(t *testing.T) {
+	tests := []struct {
+		out  string
+		size int64
+		mode os.FileMode
+	}{
+		{"5 81a4 1600000000\n", 5, 0644},
+		{"4096 41ed 1600000000\n", 4096, os.ModeDir | 0755},
+		{"7 a1ff 1600000000\n", 7, os.ModeSymlink | 0777},
+		{"0 89ed 1600000000\n", 0, os.ModeSetuid | 0755},
+		{"0 43ff 1600000000\n", 0, os.ModeDir | os.ModeSticky | 0777},
+		{"0 2190 1600000000\n", 0, os.ModeDevice | os.ModeCharDevice | 0620},
+		{"0 61b0 1600000000\n", 0, os.ModeDevice | 0660},
+		{"0 11a4 1600000000\n", 0, os.ModeNamedPipe | 0644},
+		{"0 c1ed 1600000000\n", 0, os.ModeSocket | 0755},
+	}
+	for _, tt := range tests {
+		fi, err := parseStat("name", tt.out)
+		if err != nil {
+			t.Errorf("%q: %v", tt.out, err)
+			continue
+		}
+		if fi.Size() != tt.size || fi.Mode() != tt.mode || !fi.ModTime().Equal(time.Unix(1600000000, 0)) || fi.Name() != "name" {
+			t.Errorf("%q: got %d %s %s, want %d %s", tt.out, fi.Size(), fi.Mode(), fi.ModTime(), tt.size, tt.mode)
+		}
+	}
+
+	for _, out := range []string{"", "5 81a4", "x 81a4 1", "5 zz 1", "5 81a4 x"} {
+		if _, err := parseStat("name", out); err == nil {
+			t.Errorf("%q: parsed", out)
+		}
+	}
+}
+
+func TestParseFileRecord(t *testing.T) {
+	mode, size, name, err := parseFileRecord("C0644 1234 file name.txt")
+	if err != nil || mode != 0644 || size != 1234 || name != "file name.txt" {
+		t.Fatalf("got %s %d %q %v", mode, size, name, err)
+	}
+	if mode, _, _, err = parseFileRecord("C4755 0 setuid"); err != nil || mode != 0755 {
+		t.Fatalf("got %s %v, want the permission bits only", mode, err)
+	}
+	for _, line := range []string{"D0755 0 dir", "C0644 12", "C0999 1 name", "C0644 -1 name", "C0644 x name"} {
+		if _, _, _, err = parseFileRecord(line); err == nil {
+			t.Errorf("%q: parsed", line)
+		}
+	}
+}
+
+func TestParseTimesRecord(t *testing.T) {
+	times, err := parseTimesRecord("T1500000000 250000 1600000000 0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !times.mtime.Equal(time.Unix(1500000000, 250000000)) || !times.atime.Equal(time.Unix(1600000000, 0)) {
+		t.Fatalf("got mtime %s atime %s", times.mtime, times.atime)
+	}
+	for _, line := range []string{"C0644 1 name", "T1 0 2", "T1 1000000 2 0", "T1 0 2 -1", "Tx 0 2 0"} {
+		if _, err = parseTimesRecord(line); err == nil {
+			t.Errorf("%q: parsed", line)
+		}
+	}
+}
+
+func TestShellQuote(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{"plain/path-1.txt", "plain/path-1.txt"},
+		{"with space", "'with space'"},
+		{"it's", `'it'\''s'`},
+		{"", "''"},
+		{"~", "~"},
+		{"~/dir name", "~/'dir name'"},
+		{"$HOME;rm *", "'$HOME;rm *'"},
+	}
+	for _, tt := range tests {
+		if got := shellQuote(tt.in); got != tt.want {
+			t.Errorf("%q: got %s, want %s", tt.in, got, tt.want)
+		}
+	}
+
+	// the shell must read every quoted word back unchanged
+	for _, in := range []string{"a b", "it's", "$(id)`id`", "tab\tand\nnewline", "*?[a]", `back\slash"`} {
+		out, err := exec.Command("sh", "-c", "printf %s "+shellQuote(in)).Output()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(out) != in {
+			t.Errorf("%q: shell read %q", in, out)
+		}
+	}
+}
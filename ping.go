@@ -0,0 +1,69 @@
+package scp
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// Kinds of ErrPing
+const (
+	PingNetwork = "network"
+	PingAuth    = "auth"
+	PingCommand = "command"
+)
+
+// ErrPing Ping failed at Kind: PingNetwork to reach the host, PingAuth to log
+// in or trust its key, PingCommand to run a command
+type ErrPing struct {
+	Kind string
+	Err  error
+}
+
+func (err ErrPing) Error() string {
+	return fmt.Sprintf("ping %s error: %s", err.Kind, err.Err.Error())
+}
+
+func (err ErrPing) Unwrap() error {
+	return err.Err
+}
+
+// Ping check the host is reachable and the credentials work by running true
+// over a session, dialing only when no client is cached or pooled
+func (s *scpHelperDelegate) Ping() error {
+	session, err := s.openSession(context.Background())
+	if err != nil {
+		return ErrPing{Kind: pingKind(err), Err: err}
+	}
+	defer session.Close()
+
+	var stderr bytes.Buffer
+	session.Stderr = &stderr
+	if err = session.Run("true"); err != nil {
+		return ErrPing{Kind: PingCommand, Err: remoteError(session, &stderr, err)}
+	}
+	return nil
+}
+
+// pingKind classify a session error as auth or network
+func pingKind(err error) string {
+	var (
+		mismatch *HostKeyMismatchError
+		keyErr   *knownhosts.KeyError
+		cert     ErrCertificate
+		keyRead  ErrKeyRead
+		keyParse ErrKeyParse
+	)
+	switch {
+	case errors.As(err, &mismatch), errors.As(err, &keyErr), errors.As(err, &cert),
+		errors.As(err, &keyRead), errors.As(err, &keyParse):
+		return PingAuth
+	case strings.Contains(err.Error(), "unable to authenticate"):
+		return PingAuth
+	}
+	return PingNetwork
+}
@@ -0,0 +1,152 @@
+package scp
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Pool share one ssh client per Dialer across many helpers, dialers are
+// compared by pointer so helpers only share a connection authenticated with
+// their own keys and host key policy
+type Pool struct {
+	lock    sync.Mutex
+	clients map[*Dialer]*pooledClient
+}
+
+// NewPool New empty Pool
+func NewPool() *Pool {
+	return &Pool{clients: make(map[*Dialer]*pooledClient)}
+}
+
+// Get return a Helper backed by the pooled client of dialer, the client is
+// dialed lazily and redialed when the connection drops
+func (p *Pool) Get(dialer *Dialer) Helper {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	pc, ok := p.clients[dialer]
+	if !ok {
+		pc = &pooledClient{dialer: dialer}
+		p.clients[dialer] = pc
+	}
+	pc.refs++
+	h := newHelperDelegate(dialer)
+	h.shared = pc
+	return h
+}
+
+// Put give back a Helper obtained from Get, the pooled client is closed
+// once no helper refer to it
+func (p *Pool) Put(h Helper) error {
+	s, ok := h.(*scpHelperDelegate)
+	if !ok {
+		return nil
+	}
+	s.lock.Lock()
+	pc := s.shared
+	s.shared = nil
+	s.lock.Unlock()
+	if pc == nil {
+		return nil
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if pc.refs--; pc.refs > 0 {
+		return nil
+	}
+	delete(p.clients, pc.dialer)
+	return pc.close()
+}
+
+// CloseAll close every pooled client, helpers still in use redial on next copy
+func (p *Pool) CloseAll() error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	var err error
+	for dialer, pc := range p.clients {
+		if cerr := pc.close(); cerr != nil && err == nil {
+			err = cerr
+		}
+		delete(p.clients, dialer)
+	}
+	return err
+}
+
+// pooledClient ssh client shared by every helper of a Pool with the same dialer
+type pooledClient struct {
+	dialer *Dialer
+	lock   sync.Mutex
+	client *ssh.Client
+	refs   int
+}
+
+func (c *pooledClient) newSession(ctx context.Context, logger Logger, keepAliveInterval time.Duration, onReconnect func(error)) (*ssh.Session, error) {
+	// dropped session error handed to onReconnect, called once unlocked
+	var dropped error
+	defer func() {
+		if dropped != nil && onReconnect != nil {
+			onReconnect(dropped)
+		}
+	}()
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	// first session failure of a dead connection, joined to later errors
+	var first error
+	if c.client != nil {
+		sess, err := c.client.NewSession()
+		if err == nil {
+			return sess, nil
+		}
+		var refused *ssh.OpenChannelError
+		if errors.As(err, &refused) {
+			// the connection is alive, e.g. at MaxSessions, keep it for the
+			// sessions in flight
+			return nil, err
+		}
+		logger.Warnf("new session on pooled %s fail, reconnecting: %v", c.dialer.SSHAddr, err)
+		c.client.Close()
+		c.client = nil
+		first = err
+		dropped = err
+		if err = ctx.Err(); err != nil {
+			return nil, errors.Join(first, err)
+		}
+	}
+
+	logger.Debugf("dial pooled %s@%s", c.dialer.SSHUser, c.dialer.SSHAddr)
+	client, err := c.dialer.DialContext(ctx)
+	if err != nil {
+		logger.Warnf("dial pooled %s fail: %v", c.dialer.SSHAddr, err)
+		if first != nil {
+			err = errors.Join(first, err)
+		}
+		return nil, err
+	}
+	c.client = client
+	keepAlive(client, keepAliveInterval, logger, c.dialer.SSHAddr)
+	sess, err := client.NewSession()
+	if err != nil && first != nil {
+		err = errors.Join(first, err)
+	}
+	return sess, err
+}
+
+func (c *pooledClient) close() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.client == nil {
+		return nil
+	}
+	err := c.client.Close()
+	c.client = nil
+	return err
+}
@@ -0,0 +1,56 @@
+package scp_test
+
+import (
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/glutwins/scp"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestPoolKeyedByDialer(t *testing.T) {
+	_, dialer := testServer(t)
+	pool := scp.NewPool()
+	defer pool.CloseAll()
+
+	h := pool.Get(&dialer)
+	defer pool.Put(h)
+	if err := h.CopyString("first", "pool.txt"); err != nil {
+		t.Fatal(err)
+	}
+
+	// same user@addr, the host key policy of this dialer must still be checked
+	strict := dialer
+	strict.HostKeyCallback = func(string, net.Addr, ssh.PublicKey) error {
+		return errors.New("host key rejected")
+	}
+	hs := pool.Get(&strict)
+	defer pool.Put(hs)
+	if err := hs.CopyString("second", "pool.txt"); err == nil {
+		t.Fatal("copy reused the connection of another dialer")
+	}
+}
+
+func TestPoolCloseAll(t *testing.T) {
+	_, dialer := testServer(t)
+	pool := scp.NewPool()
+
+	h := pool.Get(&dialer)
+	if err := h.CopyString("data", "pool.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if err := pool.CloseAll(); err != nil {
+		t.Fatal(err)
+	}
+	// the helper redial on next copy
+	if err := h.CopyString("again", "pool.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if err := pool.Put(h); err != nil {
+		t.Fatal(err)
+	}
+	if err := pool.Put(h); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,50 @@
+package scp
+
+import (
+	"context"
+	"io"
+
+	"golang.org/x/time/rate"
+)
+
+// RateLimiter token bucket shared by every helper it is given to, so the
+// total bandwidth of concurrent transfers stay under one cap
+type RateLimiter struct {
+	limiter *rate.Limiter
+}
+
+// NewRateLimiter allow bytesPerSec in total, zero or less means unlimited
+func NewRateLimiter(bytesPerSec int) *RateLimiter {
+	if bytesPerSec <= 0 {
+		return &RateLimiter{limiter: rate.NewLimiter(rate.Inf, 0)}
+	}
+	return &RateLimiter{limiter: rate.NewLimiter(rate.Limit(bytesPerSec), bytesPerSec)}
+}
+
+// reader wrap r so every read draw its size from the bucket
+func (l *RateLimiter) reader(ctx context.Context, r io.Reader) io.Reader {
+	if l == nil || l.limiter.Limit() == rate.Inf {
+		return r
+	}
+	return &limitedReader{ctx: ctx, r: r, limiter: l.limiter}
+}
+
+type limitedReader struct {
+	ctx     context.Context
+	r       io.Reader
+	limiter *rate.Limiter
+}
+
+func (lr *limitedReader) Read(p []byte) (int, error) {
+	// WaitN fail for more than the burst
+	if burst := lr.limiter.Burst(); len(p) > burst {
+		p = p[:burst]
+	}
+	n, err := lr.r.Read(p)
+	if n > 0 {
+		if werr := lr.limiter.WaitN(lr.ctx, n); werr != nil {
+			return n, werr
+		}
+	}
+	return n, err
+}
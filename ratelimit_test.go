@@ -0,0 +1,53 @@
+package scp
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRateLimiterUnlimited(t *testing.T) {
+	r := bytes.NewReader(nil)
+	if got := NewRateLimiter(0).reader(context.Background(), r); got != r {
+		t.Fatal("unlimited limiter wrapped the reader")
+	}
+	var l *RateLimiter
+	if got := l.reader(context.Background(), r); got != r {
+		t.Fatal("nil limiter wrapped the reader")
+	}
+}
+
+func TestRateLimiterShared(t *testing.T) {
+	// a burst of one second is free, the other 20KB of the two readers take 1s
+	l := NewRateLimiter(20 << 10)
+	start := time.Now()
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r := l.reader(context.Background(), bytes.NewReader(make([]byte, 20<<10)))
+			if n, err := io.Copy(ioutil.Discard, r); err != nil || n != 20<<10 {
+				t.Errorf("read %d bytes: %v", n, err)
+			}
+		}()
+	}
+	wg.Wait()
+	if elapsed := time.Since(start); elapsed < 900*time.Millisecond {
+		t.Fatalf("40KB read in %s, faster than the 20KB/s cap shared by both readers", elapsed)
+	}
+}
+
+func TestRateLimiterCanceled(t *testing.T) {
+	l := NewRateLimiter(1 << 10)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	r := l.reader(ctx, bytes.NewReader(make([]byte, 4<<10)))
+	if _, err := io.Copy(ioutil.Discard, r); err != context.Canceled {
+		t.Fatalf("got %v, want context.Canceled", err)
+	}
+}
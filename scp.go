@@ -3,17 +3,25 @@
 package scp
 
 import (
+	"bufio"
+	"bytes"
+	"errors"
 	"fmt"
+	"hash"
 	"io"
 	"os"
 	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"golang.org/x/crypto/ssh"
 )
 
 // Copy send data reader through ssh
 func Copy(size int64, mode os.FileMode, fileName string, contents io.Reader, destination string, session *ssh.Session) error {
-	return copy(size, mode, fileName, contents, destination, session, "")
+	return copy(size, mode, fileName, contents, destination, session, copyOptions{})
 }
 
 // CopyPath send file through ssh session
@@ -30,18 +38,704 @@ func CopyPath(filePath, destinationPath string, session *ssh.Session) error {
 	return Copy(s.Size(), s.Mode().Perm(), path.Base(filePath), f, destinationPath, session)
 }
 
-func copy(size int64, mode os.FileMode, fileName string, contents io.Reader, destination string, session *ssh.Session, flags string) error {
+// fileTimes modification and access times sent in a T record
+type fileTimes struct {
+	mtime time.Time
+	atime time.Time
+}
+
+// copyOptions tune a single transfer to the remote sink
+type copyOptions struct {
+	flags    string
+	times    *fileTimes
+	progress func(copied, total int64)
+	// bufferSize of the pooled body copy buffer, 0 use 32KB
+	bufferSize int
+	// hash receive the body bytes as they are sent, when not nil
+	hash hash.Hash
+	// wire trace the records sent and status bytes received, when not nil
+	wire io.Writer
+}
+
+func copy(size int64, mode os.FileMode, fileName string, contents io.Reader, destination string, session *ssh.Session, opts copyOptions) error {
 	defer session.Close()
-	go func() {
-		w, _ := session.StdinPipe()
-		defer w.Close()
-		fmt.Fprintf(w, "C%#o %d %s\n", mode, size, fileName)
-		io.Copy(w, contents)
-		fmt.Fprint(w, "\x00")
-	}()
-	cmd := fmt.Sprintf("scp %s -t %s", flags, destination)
-	if err := session.Run(cmd); err != nil {
+	flags := opts.flags
+	if opts.times != nil {
+		flags += " -p"
+	}
+	snk, err := startSink(session, fmt.Sprintf("scp %s -t %s", quoteFields(flags), shellQuote(destination)))
+	if err != nil {
 		return err
 	}
+	snk.progress = opts.progress
+	snk.hash = opts.hash
+	snk.wire = opts.wire
+	snk.bufferSize = opts.bufferSize
+	if opts.times != nil {
+		if err = snk.times(opts.times); err != nil {
+			return err
+		}
+	}
+	if err = snk.file(mode, size, fileName, contents); err != nil {
+		return err
+	}
+	return snk.wait()
+}
+
+// recordSink receive the records of a transfer
+type recordSink interface {
+	times(*fileTimes) error
+	dir(os.FileMode, string) error
+	file(os.FileMode, int64, string, io.Reader) error
+	end() error
+	// wait finish the transfer successfully
+	wait() error
+	// close release the sink, aborting the transfer unless wait was called
+	close() error
+}
+
+// shellQuote quote p as a single word of the remote shell, so spaces and
+// metacharacters are taken literally. A leading ~/ stay out of the quotes to
+// still expand to the home directory.
+func shellQuote(p string) string {
+	var home string
+	if p == "~" {
+		return p
+	} else if strings.HasPrefix(p, "~/") {
+		home, p = "~/", p[2:]
+	}
+	if p != "" && strings.IndexFunc(p, isShellSpecial) < 0 {
+		return home + p
+	}
+	return home + "'" + strings.Replace(p, "'", `'\''`, -1) + "'"
+}
+
+// isShellSpecial report whether r need quoting in a shell word
+func isShellSpecial(r rune) bool {
+	switch {
+	case 'a' <= r && r <= 'z', 'A' <= r && r <= 'Z', '0' <= r && r <= '9':
+		return false
+	}
+	return !strings.ContainsRune("-_./+,:@%=", r)
+}
+
+// quoteFields quote every space separated word of flags
+func quoteFields(flags string) string {
+	words := strings.Fields(flags)
+	for i, w := range words {
+		words[i] = shellQuote(w)
+	}
+	return strings.Join(words, " ")
+}
+
+// sink drive the remote "scp -t" end of the protocol
+type sink struct {
+	session  *ssh.Session
+	w        io.WriteCloser
+	r        *bufio.Reader
+	stderr   bytes.Buffer
+	progress func(copied, total int64)
+	// bufferSize of the pooled body copy buffer, 0 use 32KB
+	bufferSize int
+	hash       hash.Hash
+	wire       io.Writer
+}
+
+func startSink(session *ssh.Session, cmd string) (*sink, error) {
+	w, err := session.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := session.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	s := &sink{session: session, w: w, r: bufio.NewReader(stdout)}
+	session.Stderr = &s.stderr
+
+	if err = session.Start(cmd); err != nil {
+		return nil, err
+	}
+	if err = s.ack(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// ack read a status byte, when the remote is gone report why it exited
+func (s *sink) ack() error {
+	err := readAck(s.r)
+	if s.wire != nil {
+		switch e := err.(type) {
+		case nil:
+			fmt.Fprintf(s.wire, "< %q\n", "\x00")
+		case *ErrAck:
+			status := "\x01"
+			if e.Fatal {
+				status = "\x02"
+			}
+			fmt.Fprintf(s.wire, "< %q\n", status+e.Msg+"\n")
+		default:
+			fmt.Fprintf(s.wire, "< error: %v\n", err)
+		}
+	}
+	return remoteError(s.session, &s.stderr, err)
+}
+
+// record send a protocol message, traced to wire when set. A failed write
+// usually mean the remote exited, so report why.
+func (s *sink) record(format string, a ...interface{}) error {
+	msg := fmt.Sprintf(format, a...)
+	if s.wire != nil {
+		fmt.Fprintf(s.wire, "> %q\n", msg)
+	}
+	if _, err := io.WriteString(s.w, msg); err != nil {
+		return remoteError(s.session, &s.stderr, err)
+	}
 	return nil
 }
+
+func (s *sink) file(mode os.FileMode, size int64, name string, contents io.Reader) error {
+	if err := s.record("C%#o %d %s\n", mode, size, name); err != nil {
+		return err
+	}
+	if err := s.ack(); err != nil {
+		return err
+	}
+	src := contents
+	var p *progressReader
+	if s.progress != nil {
+		p = &progressReader{r: contents, fn: s.progress, total: size}
+		contents = p
+	}
+	body := io.LimitReader(contents, size)
+	if s.hash != nil {
+		body = io.TeeReader(body, s.hash)
+	}
+	written, err := copyBuffer(s.w, body, s.bufferSize)
+	if err != nil {
+		// the remote wait for the rest of the body, abort it
+		err = remoteError(s.session, &s.stderr, err)
+		s.session.Close()
+		return PartialTransferError{Written: written, Total: size, Err: err}
+	}
+	if written < size {
+		// the remote wait for more, abort rather than desync the stream
+		s.session.Close()
+		return SizeMismatchError{Size: size, Actual: written}
+	}
+	if err := checkDrained(src, size); err != nil {
+		// the remote wait for the end byte, abort before the file is complete
+		s.session.Close()
+		return err
+	}
+	if err := s.record("\x00"); err != nil {
+		return err
+	}
+	if err := s.ack(); err != nil {
+		return err
+	}
+	if p != nil {
+		p.finish()
+	}
+	return nil
+}
+
+// checkDrained report a SizeMismatchError when r still yield data after size
+// bytes. Readers knowing their length, such as bytes.Reader or a seekable
+// file, are checked without reading, others are read one byte, which wait
+// for a stream to yield more or end.
+func checkDrained(r io.Reader, size int64) error {
+	switch v := r.(type) {
+	case interface{ Len() int }:
+		if n := v.Len(); n > 0 {
+			return SizeMismatchError{Size: size, Actual: size + int64(n)}
+		}
+		return nil
+	case io.Seeker:
+		if left, err := seekLeft(v); err == nil {
+			if left > 0 {
+				return SizeMismatchError{Size: size, Actual: size + left}
+			}
+			return nil
+		}
+	}
+	if n, _ := r.Read(make([]byte, 1)); n > 0 {
+		return SizeMismatchError{Size: size, Actual: size + int64(n)}
+	}
+	return nil
+}
+
+// seekLeft bytes between the position of s and its end, s stay in place
+func seekLeft(s io.Seeker) (int64, error) {
+	cur, err := s.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return 0, err
+	}
+	end, err := s.Seek(0, io.SeekEnd)
+	if err != nil {
+		return 0, err
+	}
+	if _, err = s.Seek(cur, io.SeekStart); err != nil {
+		return 0, err
+	}
+	return end - cur, nil
+}
+
+func (s *sink) times(t *fileTimes) error {
+	if err := s.record("T%d 0 %d 0\n", t.mtime.Unix(), t.atime.Unix()); err != nil {
+		return err
+	}
+	return s.ack()
+}
+
+func (s *sink) dir(mode os.FileMode, name string) error {
+	if err := s.record("D%#o 0 %s\n", mode, name); err != nil {
+		return err
+	}
+	return s.ack()
+}
+
+func (s *sink) end() error {
+	if err := s.record("E\n"); err != nil {
+		return err
+	}
+	return s.ack()
+}
+
+func (s *sink) wait() error {
+	s.w.Close()
+	return remoteError(s.session, &s.stderr, s.session.Wait())
+}
+
+func (s *sink) close() error {
+	return s.session.Close()
+}
+
+// RemoteError remote scp exited with Status, Stderr hold what it printed
+type RemoteError struct {
+	Status int
+	Stderr string
+	Err    error
+}
+
+func (err RemoteError) Error() string {
+	if msg := strings.TrimSpace(err.Stderr); msg != "" {
+		return fmt.Sprintf("remote exit status %d: %s", err.Status, msg)
+	}
+	return fmt.Sprintf("remote exit status %d", err.Status)
+}
+
+func (err RemoteError) Unwrap() error {
+	return err.Err
+}
+
+// remoteError wrap err into RemoteError once the remote command exited,
+// waiting for the exit status when err tell the remote end is gone
+func remoteError(session *ssh.Session, stderr *bytes.Buffer, err error) error {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		if werr := session.Wait(); werr != nil {
+			err = werr
+		}
+	}
+	if eerr, ok := err.(*ssh.ExitError); ok {
+		return &RemoteError{Status: eerr.ExitStatus(), Stderr: stderr.String(), Err: err}
+	}
+	return err
+}
+
+// defaultBufferSize copy buffer size when none is set
+const defaultBufferSize = 32 * 1024
+
+// bufferPools copy buffers reused across transfers, a *sync.Pool per size
+var bufferPools sync.Map
+
+// bufferPool pool of size bytes buffers
+func bufferPool(size int) *sync.Pool {
+	if p, ok := bufferPools.Load(size); ok {
+		return p.(*sync.Pool)
+	}
+	p, _ := bufferPools.LoadOrStore(size, &sync.Pool{New: func() interface{} {
+		b := make([]byte, size)
+		return &b
+	}})
+	return p.(*sync.Pool)
+}
+
+// copyBuffer io.CopyBuffer through a pooled buffer of size bytes, 0 use 32KB
+func copyBuffer(dst io.Writer, src io.Reader, size int) (int64, error) {
+	if size <= 0 {
+		size = defaultBufferSize
+	}
+	pool := bufferPool(size)
+	bp := pool.Get().(*[]byte)
+	defer pool.Put(bp)
+	return io.CopyBuffer(dst, src, *bp)
+}
+
+// progressStep bytes read between two progress reports
+const progressStep = 64 * 1024
+
+// progressReader report bytes read to fn every progressStep bytes
+type progressReader struct {
+	r        io.Reader
+	fn       func(copied, total int64)
+	copied   int64
+	total    int64
+	last     int64
+	reported bool
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	p.copied += int64(n)
+	if p.copied-p.last >= progressStep {
+		p.report()
+	}
+	return n, err
+}
+
+func (p *progressReader) report() {
+	p.last = p.copied
+	p.reported = true
+	p.fn(p.copied, p.total)
+}
+
+// finish fire the final report unless it was already sent
+func (p *progressReader) finish() {
+	if !p.reported || p.last != p.copied {
+		p.report()
+	}
+}
+
+// ErrAck error message replied by remote scp instead of a zero status byte
+type ErrAck struct {
+	Fatal bool
+	Msg   string
+}
+
+func (err ErrAck) Error() string {
+	// the remote scp usually prefix its own messages
+	msg := strings.TrimPrefix(err.Msg, "scp: ")
+	if err.Fatal {
+		return "scp fatal: " + msg
+	}
+	return "scp: " + msg
+}
+
+// PartialTransferError the body of a file failed after Written of Total bytes
+type PartialTransferError struct {
+	Written int64
+	Total   int64
+	Err     error
+}
+
+func (err PartialTransferError) Error() string {
+	return fmt.Sprintf("transfer fail after %d/%d bytes: %s", err.Written, err.Total, err.Err.Error())
+}
+
+func (err PartialTransferError) Unwrap() error {
+	return err.Err
+}
+
+// SizeMismatchError the reader of a file did not yield the Size bytes
+// declared in its header. A short reader abort the transfer, a longer one
+// is truncated at Size and Actual count only the first extra bytes read.
+type SizeMismatchError struct {
+	Size   int64
+	Actual int64
+}
+
+func (err SizeMismatchError) Error() string {
+	if err.Actual > err.Size {
+		return fmt.Sprintf("reader yield more than the declared %d bytes", err.Size)
+	}
+	return fmt.Sprintf("reader yield %d bytes, %d declared", err.Actual, err.Size)
+}
+
+// Fetch receive remote file through ssh session and write it to w
+func Fetch(remotePath string, w io.Writer, session *ssh.Session) (int64, error) {
+	return fetch(remotePath, "", func(os.FileMode, int64, string, *fileTimes) (io.Writer, error) {
+		return w, nil
+	}, session)
+}
+
+// fetch run "scp -f" on remotePath and write the file into the writer
+// returned by open, with the times of the T record sent before it, if any
+func fetch(remotePath, flags string, open func(os.FileMode, int64, string, *fileTimes) (io.Writer, error), session *ssh.Session) (int64, error) {
+	defer session.Close()
+	w, err := session.StdinPipe()
+	if err != nil {
+		return 0, err
+	}
+	defer w.Close()
+	stdout, err := session.StdoutPipe()
+	if err != nil {
+		return 0, err
+	}
+	r := bufio.NewReader(stdout)
+	var stderr bytes.Buffer
+	session.Stderr = &stderr
+
+	if err = session.Start(fmt.Sprintf("scp %s -f %s", quoteFields(flags), shellQuote(remotePath))); err != nil {
+		return 0, err
+	}
+
+	if err = sendAck(w); err != nil {
+		return 0, err
+	}
+	line, err := readRecord(r)
+	if err != nil {
+		return 0, remoteError(session, &stderr, err)
+	}
+	var times *fileTimes
+	if strings.HasPrefix(line, "T") {
+		if times, err = parseTimesRecord(line); err != nil {
+			return 0, err
+		}
+		if err = sendAck(w); err != nil {
+			return 0, err
+		}
+		if line, err = readRecord(r); err != nil {
+			return 0, remoteError(session, &stderr, err)
+		}
+	}
+	mode, size, name, err := parseFileRecord(line)
+	if err != nil {
+		return 0, err
+	}
+	if err = sendAck(w); err != nil {
+		return 0, err
+	}
+
+	dst, err := open(mode, size, name, times)
+	if err != nil {
+		return 0, err
+	}
+	n, err := io.CopyN(dst, r, size)
+	if err != nil {
+		return n, err
+	}
+	if err = readAck(r); err != nil {
+		return n, err
+	}
+	if err = sendAck(w); err != nil {
+		return n, err
+	}
+	w.Close()
+	return n, remoteError(session, &stderr, session.Wait())
+}
+
+// readRecord read one protocol line, turning error status replies into ErrAck
+func readRecord(r *bufio.Reader) (string, error) {
+	b, err := r.ReadByte()
+	if err != nil {
+		return "", err
+	}
+	if b == 1 || b == 2 {
+		msg, _ := r.ReadString('\n')
+		return "", &ErrAck{Fatal: b == 2, Msg: strings.TrimSuffix(msg, "\n")}
+	}
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return string(b) + strings.TrimSuffix(line, "\n"), nil
+}
+
+// readAck read a single status byte replied by remote scp
+func readAck(r *bufio.Reader) error {
+	b, err := r.ReadByte()
+	if err != nil {
+		return err
+	}
+	switch b {
+	case 0:
+		return nil
+	case 1, 2:
+		msg, _ := r.ReadString('\n')
+		return &ErrAck{Fatal: b == 2, Msg: strings.TrimSuffix(msg, "\n")}
+	}
+	return fmt.Errorf("scp: unexpected status byte %#x", b)
+}
+
+func sendAck(w io.Writer) error {
+	_, err := w.Write([]byte{0})
+	return err
+}
+
+// parseFileRecord parse a "C<mode> <size> <name>" record
+func parseFileRecord(line string) (os.FileMode, int64, string, error) {
+	if !strings.HasPrefix(line, "C") {
+		return 0, 0, "", fmt.Errorf("scp: unexpected record %q", line)
+	}
+	parts := strings.SplitN(line[1:], " ", 3)
+	if len(parts) != 3 {
+		return 0, 0, "", fmt.Errorf("scp: malformed record %q", line)
+	}
+	mode, err := strconv.ParseUint(parts[0], 8, 32)
+	if err != nil {
+		return 0, 0, "", fmt.Errorf("scp: malformed mode in record %q", line)
+	}
+	size, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil || size < 0 {
+		return 0, 0, "", fmt.Errorf("scp: malformed size in record %q", line)
+	}
+	return os.FileMode(mode).Perm(), size, parts[2], nil
+}
+
+// parseTimesRecord parse a "T<mtime> <usec> <atime> <usec>" record
+func parseTimesRecord(line string) (*fileTimes, error) {
+	var mtime, musec, atime, ausec int64
+	if _, err := fmt.Sscanf(line, "T%d %d %d %d", &mtime, &musec, &atime, &ausec); err != nil {
+		return nil, fmt.Errorf("scp: malformed record %q", line)
+	}
+	if musec < 0 || musec > 999999 || ausec < 0 || ausec > 999999 {
+		return nil, fmt.Errorf("scp: malformed microseconds in record %q", line)
+	}
+	return &fileTimes{mtime: time.Unix(mtime, musec*1000), atime: time.Unix(atime, ausec*1000)}, nil
+}
+
+// ErrNotExist remote path does not exist
+var ErrNotExist = errors.New("remote file does not exist")
+
+// Stat query remote file info through ssh session, with GNU or busybox stat
+// when stat -c work on /, otherwise BSD stat
+func Stat(remotePath string, session *ssh.Session) (os.FileInfo, error) {
+	defer session.Close()
+	var stdout, stderr bytes.Buffer
+	session.Stdout = &stdout
+	session.Stderr = &stderr
+
+	quoted := shellQuote(remotePath)
+	// pick the flavour up front, a failing GNU stat must not fall through to
+	// stat -f, which GNU read as file system mode
+	cmd := fmt.Sprintf("if stat -c %%s / >/dev/null 2>&1; then stat -c '%%s %%f %%Y' -- %s; else stat -f '%%z %%Xp %%m' -- %s; fi", quoted, quoted)
+	if err := session.Run(cmd); err != nil {
+		if strings.Contains(stderr.String(), "No such file") {
+			return nil, ErrNotExist
+		}
+		return nil, remoteError(session, &stderr, err)
+	}
+	return parseStat(path.Base(remotePath), stdout.String())
+}
+
+// parseStat parse "<size> <hex raw mode> <mtime>" printed by stat
+func parseStat(name, out string) (os.FileInfo, error) {
+	fields := strings.Fields(out)
+	if len(fields) != 3 {
+		return nil, fmt.Errorf("scp: unexpected stat output %q", out)
+	}
+	size, err := strconv.ParseInt(fields[0], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("scp: unexpected stat size %q", fields[0])
+	}
+	raw, err := strconv.ParseUint(fields[1], 16, 32)
+	if err != nil {
+		return nil, fmt.Errorf("scp: unexpected stat mode %q", fields[1])
+	}
+	mtime, err := strconv.ParseInt(fields[2], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("scp: unexpected stat mtime %q", fields[2])
+	}
+	return &remoteFileInfo{name: name, size: size, mode: unixMode(uint32(raw)), modTime: time.Unix(mtime, 0)}, nil
+}
+
+// unixMode convert a raw st_mode into os.FileMode
+func unixMode(raw uint32) os.FileMode {
+	mode := os.FileMode(raw & 0777)
+	switch raw & 0170000 {
+	case 0040000:
+		mode |= os.ModeDir
+	case 0120000:
+		mode |= os.ModeSymlink
+	case 0010000:
+		mode |= os.ModeNamedPipe
+	case 0140000:
+		mode |= os.ModeSocket
+	case 0020000:
+		mode |= os.ModeDevice | os.ModeCharDevice
+	case 0060000:
+		mode |= os.ModeDevice
+	}
+	if raw&04000 != 0 {
+		mode |= os.ModeSetuid
+	}
+	if raw&02000 != 0 {
+		mode |= os.ModeSetgid
+	}
+	if raw&01000 != 0 {
+		mode |= os.ModeSticky
+	}
+	return mode
+}
+
+// remoteFileInfo os.FileInfo of a remote file
+type remoteFileInfo struct {
+	name    string
+	size    int64
+	mode    os.FileMode
+	modTime time.Time
+}
+
+func (fi *remoteFileInfo) Name() string       { return fi.name }
+func (fi *remoteFileInfo) Size() int64        { return fi.size }
+func (fi *remoteFileInfo) Mode() os.FileMode  { return fi.mode }
+func (fi *remoteFileInfo) ModTime() time.Time { return fi.modTime }
+func (fi *remoteFileInfo) IsDir() bool        { return fi.mode.IsDir() }
+func (fi *remoteFileInfo) Sys() interface{}   { return nil }
+
+// Checksum run cmd, such as "sha256sum", on remotePath through ssh session and
+// return the hex digest it print
+func Checksum(cmd, remotePath string, session *ssh.Session) (string, error) {
+	defer session.Close()
+	var stdout, stderr bytes.Buffer
+	session.Stdout = &stdout
+	session.Stderr = &stderr
+
+	if err := session.Run(fmt.Sprintf("%s %s", cmd, shellQuote(remotePath))); err != nil {
+		if strings.Contains(stderr.String(), "No such file") {
+			return "", ErrNotExist
+		}
+		return "", remoteError(session, &stderr, err)
+	}
+	fields := strings.Fields(stdout.String())
+	if len(fields) == 0 {
+		return "", fmt.Errorf("scp: unexpected %s output %q", cmd, stdout.String())
+	}
+	return strings.ToLower(fields[0]), nil
+}
+
+// FreeSpace return the bytes available to the user in the filesystem of
+// remoteDir through ssh session, using GNU df or falling back to POSIX df -Pk
+func FreeSpace(remoteDir string, session *ssh.Session) (int64, error) {
+	defer session.Close()
+	var stdout, stderr bytes.Buffer
+	session.Stdout = &stdout
+	session.Stderr = &stderr
+
+	quoted := shellQuote(remoteDir)
+	cmd := fmt.Sprintf("df -B1 --output=avail %s 2>/dev/null || df -Pk %s", quoted, quoted)
+	if err := session.Run(cmd); err != nil {
+		return 0, remoteError(session, &stderr, err)
+	}
+	return parseDf(stdout.String())
+}
+
+// parseDf read the available bytes from the last line printed by df, a
+// single byte count or the fourth column of df -Pk in kilobytes
+func parseDf(out string) (int64, error) {
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	fields := strings.Fields(lines[len(lines)-1])
+	switch {
+	case len(fields) == 1:
+		if avail, err := strconv.ParseInt(fields[0], 10, 64); err == nil {
+			return avail, nil
+		}
+	case len(fields) >= 4:
+		if avail, err := strconv.ParseInt(fields[3], 10, 64); err == nil {
+			return avail * 1024, nil
+		}
+	}
+	return 0, fmt.Errorf("scp: unexpected df output %q", out)
+}
@@ -0,0 +1,892 @@
+package scp_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/glutwins/scp"
+	"github.com/glutwins/scp/scptest"
+)
+
+// testServer start a StartServer in a temp dir, remote paths in the tests are
+// relative so the scp and sh commands of the server agree on them
+func testServer(t *testing.T) (root string, dialer scp.Dialer) {
+	root, err := ioutil.TempDir("", "scp-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr, cleanup, err := scptest.StartServer(root)
+	if err != nil {
+		os.RemoveAll(root)
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		cleanup()
+		os.RemoveAll(root)
+	})
+	return root, scptest.Dialer(addr)
+}
+
+func testHelper(t *testing.T) (string, scp.Helper) {
+	root, dialer := testServer(t)
+	h := scp.NewHelper(&dialer)
+	h.SetBackoff(func(int) time.Duration { return 0 })
+	t.Cleanup(func() { h.Close() })
+	return root, h
+}
+
+// sample binary content with every byte value
+func sample(size int) []byte {
+	data := make([]byte, size)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	return data
+}
+
+func TestCopyFetchRoundTrip(t *testing.T) {
+	root, h := testHelper(t)
+	data := sample(200 << 10)
+	if err := h.CopyBytes(data, "round.bin"); err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadFile(filepath.Join(root, "round.bin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatalf("remote file differ, %d bytes, want %d", len(got), len(data))
+	}
+
+	var buf bytes.Buffer
+	n, err := h.Fetch("round.bin", &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != int64(len(data)) || !bytes.Equal(buf.Bytes(), data) {
+		t.Fatalf("fetched %d bytes differ from the %d sent", n, len(data))
+	}
+}
+
+func TestCopyPathPreserveTimes(t *testing.T) {
+	root, h := testHelper(t)
+	src := filepath.Join(t.TempDir(), "local.txt")
+	if err := ioutil.WriteFile(src, []byte("hello"), 0640); err != nil {
+		t.Fatal(err)
+	}
+	mtime := time.Unix(1500000000, 0)
+	if err := os.Chtimes(src, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+
+	h.SetPreserveTimes(true)
+	if err := h.CopyPath(src, "copied.txt"); err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Stat(filepath.Join(root, "copied.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !fi.ModTime().Equal(mtime) || fi.Mode().Perm() != 0640 {
+		t.Fatalf("got mtime %s mode %s, want %s %s", fi.ModTime(), fi.Mode().Perm(), mtime, os.FileMode(0640))
+	}
+}
+
+func TestCopyPathRejectDirectory(t *testing.T) {
+	root, h := testHelper(t)
+	if err := h.CopyPath(t.TempDir(), "dir.copy"); err == nil {
+		t.Fatal("copy of a directory succeed")
+	}
+	if _, err := os.Stat(filepath.Join(root, "dir.copy")); !os.IsNotExist(err) {
+		t.Fatalf("remote file created: %v", err)
+	}
+}
+
+func TestCopyErrorReply(t *testing.T) {
+	_, h := testHelper(t)
+	err := h.CopyString("data", "missing/dir/file")
+	if err == nil {
+		t.Fatal("copy into a missing directory succeed")
+	}
+	var ack *scp.ErrAck
+	if !errors.As(err, &ack) {
+		t.Fatalf("got %T %v, want ErrAck", err, err)
+	}
+	if strings.HasPrefix(ack.Error(), "scp: scp:") {
+		t.Fatalf("doubled prefix in %q", ack.Error())
+	}
+}
+
+func TestStat(t *testing.T) {
+	root, h := testHelper(t)
+	mtime := time.Unix(1600000000, 0)
+	p := filepath.Join(root, "stat.txt")
+	if err := ioutil.WriteFile(p, []byte("12345"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(p, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+
+	fi, err := h.Stat("stat.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Size() != 5 || fi.Mode().Perm() != 0600 || !fi.Mode().IsRegular() || !fi.ModTime().Equal(mtime) {
+		t.Fatalf("got size %d mode %s mtime %s", fi.Size(), fi.Mode(), fi.ModTime())
+	}
+	if fi, err = h.Stat("."); err != nil || !fi.IsDir() {
+		t.Fatalf("stat of the root: %v %v", fi, err)
+	}
+	if _, err = h.Stat("nope.txt"); err != scp.ErrNotExist {
+		t.Fatalf("got %v, want ErrNotExist", err)
+	}
+	var rerr *scp.RemoteError
+	if _, err = h.Stat("stat.txt/sub"); !errors.As(err, &rerr) || !strings.Contains(rerr.Stderr, "Not a directory") {
+		t.Fatalf("got %v, want the Not a directory RemoteError", err)
+	}
+}
+
+func TestChecksum(t *testing.T) {
+	root, dialer := testServer(t)
+	data := sample(1000)
+	if err := ioutil.WriteFile(filepath.Join(root, "sum.bin"), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	client, err := dialer.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	session, err := client.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum, err := scp.Checksum("sha256sum", "sum.bin", session)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := sha256.Sum256(data)
+	if sum != hex.EncodeToString(want[:]) {
+		t.Fatalf("got %s, want %x", sum, want)
+	}
+
+	if session, err = client.NewSession(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = scp.Checksum("sha256sum", "nope.bin", session); err != scp.ErrNotExist {
+		t.Fatalf("got %v, want ErrNotExist", err)
+	}
+}
+
+func TestAtomicRename(t *testing.T) {
+	root, h := testHelper(t)
+	if err := os.Mkdir(filepath.Join(root, "dir"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(root, "dir", "app"), []byte("old"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	h.SetAtomic(true)
+	if err := h.CopyString("new content", "dir/app"); err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadFile(filepath.Join(root, "dir", "app"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "new content" {
+		t.Fatalf("got %q after rename", got)
+	}
+	entries, err := ioutil.ReadDir(filepath.Join(root, "dir"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("temp file left beside the target: %d entries", len(entries))
+	}
+}
+
+// flakyReaderAt fail the first read at or past failAt
+type flakyReaderAt struct {
+	data   []byte
+	failAt int64
+	lock   sync.Mutex
+	failed bool
+}
+
+func (r *flakyReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if !r.failed && off+int64(len(p)) > r.failAt {
+		r.failed = true
+		n := 0
+		if off < r.failAt {
+			n = copy(p, r.data[off:r.failAt])
+		}
+		return n, errors.New("flaky read")
+	}
+	if off >= int64(len(r.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, r.data[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// logRecorder Logger keeping the Infof messages
+type logRecorder struct {
+	lock  sync.Mutex
+	infos []string
+}
+
+func (l *logRecorder) Debugf(string, ...interface{}) {}
+func (l *logRecorder) Warnf(string, ...interface{})  {}
+func (l *logRecorder) Infof(format string, args ...interface{}) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.infos = append(l.infos, fmt.Sprintf(format, args...))
+}
+
+func (l *logRecorder) resumed() bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	for _, msg := range l.infos {
+		if strings.HasPrefix(msg, "resume ") {
+			return true
+		}
+	}
+	return false
+}
+
+func TestRetryResume(t *testing.T) {
+	root, h := testHelper(t)
+	logs := &logRecorder{}
+	h.SetLogger(logs)
+	h.SetResume(true)
+	h.SetHash(sha256.New())
+
+	data := sample(512 << 10)
+	r := &flakyReaderAt{data: data, failAt: 128 << 10}
+	if err := h.TryCopyReaderAt(r, int64(len(data)), "resume.bin", 2); err != nil {
+		t.Fatal(err)
+	}
+	if sum := sha256.Sum256(data); !bytes.Equal(h.Sum(), sum[:]) {
+		t.Fatalf("got sum %x, want %x of the whole file", h.Sum(), sum)
+	}
+	got, err := ioutil.ReadFile(filepath.Join(root, "resume.bin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatalf("resumed file differ, %d bytes, want %d", len(got), len(data))
+	}
+	if !logs.resumed() {
+		t.Fatal("retry copied the file again instead of resuming")
+	}
+}
+
+func TestRetryNoResumeOfForeignFile(t *testing.T) {
+	root, h := testHelper(t)
+	logs := &logRecorder{}
+	h.SetLogger(logs)
+	h.SetResume(true)
+
+	// a shorter file of another run, the failed attempt write nothing
+	if err := ioutil.WriteFile(filepath.Join(root, "foreign.bin"), []byte("stale"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	data := sample(64 << 10)
+	r := &flakyReaderAt{data: data, failAt: 0}
+	if err := h.TryCopyReaderAt(r, int64(len(data)), "foreign.bin", 2); err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadFile(filepath.Join(root, "foreign.bin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatalf("file differ, %d bytes, want %d", len(got), len(data))
+	}
+	if logs.resumed() {
+		t.Fatal("resumed a file the failed attempt did not write")
+	}
+}
+
+func TestCompressFallbackStream(t *testing.T) {
+	root, h := testHelper(t)
+	if err := h.SetCompression(scp.Gzip, 0); err != nil {
+		t.Fatal(err)
+	}
+	data := make([]byte, 256<<10)
+	rand.New(rand.NewSource(1)).Read(data)
+
+	// random bytes do not compress, the plain content is replayed from the spool
+	if err := h.Copy(io.MultiReader(bytes.NewReader(data)), int64(len(data)), "random.bin"); err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadFile(filepath.Join(root, "random.bin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatalf("plain fallback differ, %d bytes, want %d", len(got), len(data))
+	}
+}
+
+func TestAtomicSharedTempDir(t *testing.T) {
+	root, h := testHelper(t)
+	src := t.TempDir()
+	for i := 0; i < 6; i++ {
+		dir := filepath.Join(src, fmt.Sprintf("d%d", i))
+		if err := os.Mkdir(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, "same"), []byte(dir), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Mkdir(filepath.Join(root, "tmp"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	h.SetAtomic(true)
+	h.SetRemoteTempDir("tmp")
+	if err := h.CopyDirParallel(src, "out", 4); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 6; i++ {
+		dir := filepath.Join(src, fmt.Sprintf("d%d", i))
+		got, err := ioutil.ReadFile(filepath.Join(root, "out", fmt.Sprintf("d%d", i), "same"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != dir {
+			t.Fatalf("d%d/same hold %q", i, got)
+		}
+	}
+}
+
+func TestOnReconnectCallHelper(t *testing.T) {
+	_, dialer := testServer(t)
+	var lock sync.Mutex
+	var conns []net.Conn
+	dialer.DialFunc = func(network, addr string) (net.Conn, error) {
+		conn, err := net.Dial(network, addr)
+		if err == nil {
+			lock.Lock()
+			conns = append(conns, conn)
+			lock.Unlock()
+		}
+		return conn, err
+	}
+	h := scp.NewHelper(&dialer)
+	defer h.Close()
+
+	if err := h.CopyString("first", "a.txt"); err != nil {
+		t.Fatal(err)
+	}
+	reconnected := make(chan error, 1)
+	h.SetOnReconnect(func(error) {
+		// the helper must be usable from the callback
+		_, err := h.Stat("a.txt")
+		reconnected <- err
+	})
+	lock.Lock()
+	conns[0].Close()
+	lock.Unlock()
+
+	done := make(chan error, 1)
+	go func() { done <- h.CopyString("second", "b.txt") }()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("copy blocked, the reconnect callback deadlocked")
+	}
+	select {
+	case err := <-reconnected:
+		if err != nil {
+			t.Fatal(err)
+		}
+	default:
+		t.Fatal("reconnect callback not called")
+	}
+}
+
+func TestDialTimeoutUnwrap(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	// accept but never answer the handshake
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	dialer := scp.Dialer{SSHUser: "test", SSHPass: "test", SSHAddr: l.Addr().String(), InsecureIgnoreHostKey: true}
+	dialer.DialTimeout = 100 * time.Millisecond
+	_, err = dialer.Dial()
+	var timeout *scp.ErrDialTimeout
+	if !errors.As(err, &timeout) {
+		t.Fatalf("got %T %v, want ErrDialTimeout", err, err)
+	}
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("%v do not unwrap to os.ErrDeadlineExceeded", err)
+	}
+}
+
+func TestVerifyBinarySafeStaleCompressed(t *testing.T) {
+	root, h := testHelper(t)
+	if err := h.SetCompression(scp.Gzip, 0); err != nil {
+		t.Fatal(err)
+	}
+	// a compressed file of an earlier run, with other content
+	var stale bytes.Buffer
+	zw := gzip.NewWriter(&stale)
+	zw.Write([]byte("older content"))
+	zw.Close()
+	if err := ioutil.WriteFile(filepath.Join(root, "check.bin.gz"), stale.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// random bytes are sent plain, the stale file must not be compared
+	data := make([]byte, 64<<10)
+	rand.New(rand.NewSource(2)).Read(data)
+	if err := h.VerifyBinarySafe(data, "check.bin"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(root, "check.bin.gz")); !os.IsNotExist(err) {
+		t.Fatalf("stale compressed file kept: %v", err)
+	}
+}
+
+func TestMaxFileSizeBeforePreCommand(t *testing.T) {
+	root, h := testHelper(t)
+	h.SetMaxFileSize(4)
+	h.SetPreCommand("touch pre.marker")
+	err := h.CopyString("too large", "large.txt")
+	var tooLarge scp.ErrFileTooLarge
+	if !errors.As(err, &tooLarge) {
+		t.Fatalf("got %v, want ErrFileTooLarge", err)
+	}
+	if _, err = os.Stat(filepath.Join(root, "pre.marker")); !os.IsNotExist(err) {
+		t.Fatalf("pre command run for a rejected file: %v", err)
+	}
+}
+
+func TestRetryableError(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"nil", nil, false},
+		{"network", &net.OpError{Op: "read", Err: errors.New("connection reset")}, true},
+		{"dropped connection", io.ErrUnexpectedEOF, true},
+		{"scp not installed", &scp.RemoteError{Status: 127, Stderr: "sh: scp: not found"}, false},
+		{"wrapped remote", scp.PartialTransferError{Written: 1, Total: 2, Err: &scp.RemoteError{Status: 1}}, false},
+		{"auth", scp.ErrAuth{User: "u", Addr: "h:22", Err: errors.New("ssh: unable to authenticate")}, false},
+		{"setenv rejected", scp.ErrSetenv{Name: "LANG", Err: errors.New("ssh: setenv failed")}, false},
+		{"canceled", fmt.Errorf("copy: %w", context.Canceled), false},
+		{"missing file", os.ErrNotExist, false},
+	}
+	for _, tt := range tests {
+		if got := scp.RetryableError(tt.err); got != tt.want {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestRemoteVersionRetryAfterDialFailure(t *testing.T) {
+	_, dialer := testServer(t)
+	errDown := errors.New("host down")
+	var lock sync.Mutex
+	down := true
+	dialer.DialFunc = func(network, addr string) (net.Conn, error) {
+		lock.Lock()
+		defer lock.Unlock()
+		if down {
+			return nil, errDown
+		}
+		return net.Dial(network, addr)
+	}
+	h := scp.NewHelper(&dialer)
+	defer h.Close()
+
+	if _, err := h.RemoteVersion(); !errors.Is(err, errDown) {
+		t.Fatalf("got %v, want the dial failure", err)
+	}
+	lock.Lock()
+	down = false
+	lock.Unlock()
+	if _, err := h.RemoteVersion(); errors.Is(err, errDown) {
+		t.Fatalf("dial failure cached: %v", err)
+	}
+}
+
+func TestServerRejectWrongPassword(t *testing.T) {
+	_, dialer := testServer(t)
+	dialer.SSHPass = "guess"
+	_, err := dialer.Dial()
+	var auth scp.ErrAuth
+	if !errors.As(err, &auth) {
+		t.Fatalf("got %v, want ErrAuth", err)
+	}
+	if scp.RetryableError(err) {
+		t.Fatal("rejected password reported retryable")
+	}
+}
+
+func TestCopyManySameAddr(t *testing.T) {
+	root, dialer := testServer(t)
+	bad := dialer
+	bad.SSHPass = "wrong"
+	dialers := []scp.Dialer{dialer, bad, dialer}
+
+	results := make(chan scp.CopyResult, len(dialers))
+	errs := scp.CopyManyWith(context.Background(), dialers, strings.NewReader("many"), 4, "many.txt", scp.CopyManyOptions{Results: results})
+	if len(errs) != len(dialers) {
+		t.Fatalf("got %d results for %d dialers", len(errs), len(dialers))
+	}
+	if errs[0] != nil || errs[2] != nil {
+		t.Fatalf("copies fail: %v %v", errs[0], errs[2])
+	}
+	var auth scp.ErrAuth
+	if !errors.As(errs[1], &auth) {
+		t.Fatalf("got %v for the wrong password, want ErrAuth", errs[1])
+	}
+	for r := range results {
+		if r.Err != errs[r.Index] {
+			t.Fatalf("result %d: got %v, want %v", r.Index, r.Err, errs[r.Index])
+		}
+	}
+	if got, err := ioutil.ReadFile(filepath.Join(root, "many.txt")); err != nil || string(got) != "many" {
+		t.Fatalf("got %q %v", got, err)
+	}
+}
+
+func TestLocalLimit(t *testing.T) {
+	root, h := testHelper(t)
+	// a burst of one second is free, the other 64KB take 1s
+	h.SetLocalLimit(64 << 10)
+	data := sample(128 << 10)
+	start := time.Now()
+	if err := h.CopyBytes(data, "limited.bin"); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 900*time.Millisecond {
+		t.Fatalf("128KB sent in %s, faster than 64KB/s", elapsed)
+	}
+	if got, err := ioutil.ReadFile(filepath.Join(root, "limited.bin")); err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("remote file differ: %v", err)
+	}
+}
+
+func TestCopyDir(t *testing.T) {
+	root, h := testHelper(t)
+	src := filepath.Join(t.TempDir(), "tree")
+	for _, dir := range []string{"empty", "sub/deep"} {
+		if err := os.MkdirAll(filepath.Join(src, dir), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for name, content := range map[string]string{"top.txt": "top", "sub/deep/leaf.txt": "leaf"} {
+		if err := ioutil.WriteFile(filepath.Join(src, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink("top.txt", filepath.Join(src, "link.txt")); err != nil {
+		t.Fatal(err)
+	}
+
+	// like scp -r the tree land inside an existing destination directory
+	for _, dir := range []string{"out", "follow"} {
+		if err := os.Mkdir(filepath.Join(root, dir), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := h.CopyDir(src, "out"); err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]string{"top.txt": "top", "sub/deep/leaf.txt": "leaf"} {
+		if got, err := ioutil.ReadFile(filepath.Join(root, "out", "tree", name)); err != nil || string(got) != want {
+			t.Fatalf("%s: got %q %v", name, got, err)
+		}
+	}
+	if fi, err := os.Stat(filepath.Join(root, "out", "tree", "empty")); err != nil || !fi.IsDir() {
+		t.Fatalf("empty directory not kept: %v", err)
+	}
+	if _, err := os.Lstat(filepath.Join(root, "out", "tree", "link.txt")); !os.IsNotExist(err) {
+		t.Fatalf("symlink sent without SetFollowSymlinks: %v", err)
+	}
+
+	h.SetFollowSymlinks(true)
+	if err := h.CopyDir(src, "follow"); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := ioutil.ReadFile(filepath.Join(root, "follow", "tree", "link.txt")); err != nil || string(got) != "top" {
+		t.Fatalf("followed symlink: got %q %v", got, err)
+	}
+}
+
+func TestCopyDirContinueOnError(t *testing.T) {
+	root, h := testHelper(t)
+	src := filepath.Join(t.TempDir(), "tree")
+	if err := os.Mkdir(src, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(src, "ok.txt"), []byte("ok"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := exec.Command("mkfifo", filepath.Join(src, "fifo")).Run(); err != nil {
+		t.Skipf("mkfifo: %v", err)
+	}
+
+	if err := os.Mkdir(filepath.Join(root, "keep"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.CopyDir(src, "abort"); err == nil {
+		t.Fatal("copy of a fifo succeed")
+	}
+
+	h.SetContinueOnError(true)
+	err := h.CopyDir(src, "keep")
+	var errs scp.ErrFiles
+	if !errors.As(err, &errs) || len(errs) != 1 || errs[0].Path != filepath.Join(src, "fifo") {
+		t.Fatalf("got %v, want the fifo ErrFiles", err)
+	}
+	if got, err := ioutil.ReadFile(filepath.Join(root, "keep", "tree", "ok.txt")); err != nil || string(got) != "ok" {
+		t.Fatalf("got %q %v", got, err)
+	}
+}
+
+func TestCopyFiles(t *testing.T) {
+	root, h := testHelper(t)
+	if err := os.Mkdir(filepath.Join(root, "dst"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	var files []string
+	for _, name := range []string{"a.txt", "b.txt"} {
+		p := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(p, []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+		files = append(files, p)
+	}
+
+	if err := h.CopyFiles(files, "dst"); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"a.txt", "b.txt"} {
+		if got, err := ioutil.ReadFile(filepath.Join(root, "dst", name)); err != nil || string(got) != name {
+			t.Fatalf("%s: got %q %v", name, got, err)
+		}
+	}
+
+	missing := filepath.Join(dir, "missing.txt")
+	err := h.CopyFiles([]string{files[0], missing, files[1]}, "dst")
+	var partial *scp.ErrPartial
+	if !errors.As(err, &partial) {
+		t.Fatalf("got %T %v, want ErrPartial", err, err)
+	}
+	if len(partial.Sent) != 1 || partial.Sent[0] != files[0] || partial.Failed.Path != missing || !os.IsNotExist(partial.Failed.Err) {
+		t.Fatalf("got sent %v failed %v", partial.Sent, partial.Failed)
+	}
+}
+
+func TestCopyTar(t *testing.T) {
+	root, h := testHelper(t)
+	mtime := time.Unix(1500000000, 0)
+	p := filepath.Join(t.TempDir(), "local.txt")
+	if err := ioutil.WriteFile(p, []byte("local"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(p, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+	fd, err := os.Open(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fd.Close()
+
+	if err = os.Mkdir(filepath.Join(root, "tar"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	h.SetPreserveTimes(true)
+	files := map[string]io.Reader{"a/one.txt": strings.NewReader("one"), "local.txt": fd}
+	sizes := map[string]int64{"a/one.txt": 3, "local.txt": 5}
+	if err = h.CopyTar(files, sizes, "tar"); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := ioutil.ReadFile(filepath.Join(root, "tar", "a", "one.txt")); err != nil || string(got) != "one" {
+		t.Fatalf("got %q %v", got, err)
+	}
+	fi, err := os.Stat(filepath.Join(root, "tar", "local.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !fi.ModTime().Equal(mtime) {
+		t.Fatalf("got mtime %s, want %s", fi.ModTime(), mtime)
+	}
+
+	for name, files := range map[string]map[string]io.Reader{
+		"escape":       {"../x": strings.NewReader("x")},
+		"missing size": {"nosize": strings.NewReader("x")},
+	} {
+		var ferr *scp.ErrFile
+		if err := h.CopyTar(files, map[string]int64{"../x": 1}, "tar"); !errors.As(err, &ferr) {
+			t.Fatalf("%s: got %v, want ErrFile", name, err)
+		}
+	}
+}
+
+func TestCopyAndVerify(t *testing.T) {
+	root, h := testHelper(t)
+	data := sample(100 << 10)
+	if err := h.CopyAndVerify(bytes.NewReader(data), int64(len(data)), "verify.bin"); err != nil {
+		t.Fatal(err)
+	}
+
+	h.SetAppend(true)
+	if err := h.CopyAndVerify(bytes.NewReader(data), int64(len(data)), "verify.bin"); err == nil {
+		t.Fatal("verify in append mode succeed")
+	}
+	if fi, err := os.Stat(filepath.Join(root, "verify.bin")); err != nil || fi.Size() != int64(len(data)) {
+		t.Fatalf("remote file changed by the rejected verify: %v", err)
+	}
+}
+
+func TestVerifyBinarySafeAppend(t *testing.T) {
+	root, h := testHelper(t)
+	if err := ioutil.WriteFile(filepath.Join(root, "append.bin"), []byte("prior"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	h.SetAppend(true)
+	if err := h.VerifyBinarySafe(nil, "append.bin"); err == nil {
+		t.Fatal("verify in append mode succeed")
+	}
+	if got, err := ioutil.ReadFile(filepath.Join(root, "append.bin")); err != nil || string(got) != "prior" {
+		t.Fatalf("remote file changed by the rejected verify: %q %v", got, err)
+	}
+}
+
+func TestCheckSpaceTransparent(t *testing.T) {
+	root, dialer := testServer(t)
+	client, err := dialer.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	session, err := client.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	avail, err := scp.FreeSpace(".", session)
+	if err != nil {
+		t.Skipf("df: %v", err)
+	}
+
+	h := scp.NewHelper(&dialer)
+	defer h.Close()
+	h.SetGzipEnable(true)
+	h.SetGzipTransparent(true)
+	h.SetCheckDiskSpace(true)
+	// 8MB of zeros compress to a few KB, the margin leave room for the
+	// compressed body but not for the plain one
+	data := make([]byte, 8<<20)
+	h.SetDiskSpaceMargin(avail - 4<<20)
+	err = h.CopyBytes(data, "zeros.bin")
+	var noSpace scp.ErrInsufficientSpace
+	if !errors.As(err, &noSpace) {
+		t.Fatalf("got %v, want ErrInsufficientSpace", err)
+	}
+	if _, err = os.Stat(filepath.Join(root, "zeros.bin")); !os.IsNotExist(err) {
+		t.Fatalf("remote file written: %v", err)
+	}
+}
+
+func TestDashLeadingName(t *testing.T) {
+	root, h := testHelper(t)
+	h.SetAtomic(true)
+	h.SetRemoteChmod(0600)
+	if err := h.CopyString("dash", "-rf"); err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Stat(filepath.Join(root, "-rf"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0600 {
+		t.Fatalf("got mode %s, want %s", fi.Mode().Perm(), os.FileMode(0600))
+	}
+}
+
+// streamReader reader of unknown length, neither Len nor Seek
+type streamReader struct {
+	r io.Reader
+}
+
+func (r streamReader) Read(p []byte) (int, error) {
+	return r.r.Read(p)
+}
+
+func TestCopyOverDeliveringReader(t *testing.T) {
+	root, h := testHelper(t)
+	for name, r := range map[string]io.Reader{
+		"over.txt":   strings.NewReader("too long"),
+		"stream.txt": streamReader{strings.NewReader("too long")},
+	} {
+		err := h.Copy(r, 3, name)
+		var mismatch scp.SizeMismatchError
+		if !errors.As(err, &mismatch) || mismatch.Size != 3 {
+			t.Fatalf("%s: got %v, want SizeMismatchError", name, err)
+		}
+		if _, err = os.Stat(filepath.Join(root, name)); !os.IsNotExist(err) {
+			t.Fatalf("%s: truncated file left on the remote: %v", name, err)
+		}
+	}
+
+	h.SetAtomic(true)
+	if err := h.Copy(strings.NewReader("too long"), 3, "atomic.txt"); err == nil {
+		t.Fatal("over-delivering atomic copy succeed")
+	}
+	entries, err := ioutil.ReadDir(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Fatalf("%d files left on the remote", len(entries))
+	}
+}
@@ -0,0 +1,571 @@
+// Package scptest in-memory scp.Helper, to test code using scp without sshd
+package scptest
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/glutwins/scp"
+)
+
+// File remote file recorded by MemHelper
+type File struct {
+	Data    []byte
+	Mode    os.FileMode
+	ModTime time.Time
+}
+
+// Settings value of every option set on a MemHelper
+type Settings struct {
+	LimitKbps        int
+	Compression      scp.Compression
+	CompressionLevel int
+	FollowSymlinks   bool
+	ContinueOnError  bool
+	PreserveTimes    bool
+	Progress         func(copied, total int64)
+	Backoff          scp.BackoffFunc
+	MaxRetryDuration time.Duration
+	Env              map[string]string
+	SkipIfIdentical  bool
+	VerifyChecksum   bool
+	ChecksumCommand  string
+	Mode             os.FileMode
+	Atomic           bool
+	Logger           scp.Logger
+	Metrics          scp.Metrics
+	Resume           bool
+	RateLimiter      *scp.RateLimiter
+	KeepAlive        time.Duration
+	DryRun           bool
+	MkdirParents     bool
+	MkdirMode        os.FileMode
+	GzipSuffix       *string
+	GzipTransparent  bool
+	BufferSize       int
+	TransferTimeout  time.Duration
+	RemoteChmod      os.FileMode
+	RemoteUser       string
+	RemoteGroup      string
+	PreCommand       string
+	PostCommand      string
+	GzipMinRatio     float64
+	Hash             hash.Hash
+	NoJitter         bool
+	WireLog          io.Writer
+	GzipMinSize      int64
+	EnvStrict        bool
+	MaxFileSize      int64
+	CheckDiskSpace   bool
+	DiskSpaceMargin  int64
+	TempDir          string
+	TempPrefix       string
+	RemoteTempDir    string
+	Append           bool
+	LocalLimit       int
+	OnReconnect      func(error)
+}
+
+// MemHelper scp.Helper storing uploads in Files, keyed by cleaned remote path.
+// Data is stored as sent by the caller, compression is only recorded in
+// Settings.
+type MemHelper struct {
+	lock sync.Mutex
+
+	Files    map[string]*File
+	Settings Settings
+	// Err returned by every transfer when set, nothing is recorded then
+	Err    error
+	Closed bool
+
+	dryRunBytes int64
+}
+
+var _ scp.Helper = (*MemHelper)(nil)
+
+// NewMemHelper New empty MemHelper
+func NewMemHelper() *MemHelper {
+	return &MemHelper{Files: make(map[string]*File)}
+}
+
+// File return the content recorded at path, nil when nothing was copied there
+func (m *MemHelper) File(path string) *File {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.Files[filepath.Clean(path)]
+}
+
+// put record size bytes of r as dstfile
+func (m *MemHelper) put(r io.Reader, size int64, dstfile string, mode os.FileMode, mtime time.Time) error {
+	if m.Err != nil {
+		return m.Err
+	}
+	if limit := m.Settings.MaxFileSize; limit > 0 && size > limit {
+		return scp.ErrFileTooLarge{Size: size, Limit: limit}
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(r, size))
+	if err != nil {
+		return err
+	}
+	if int64(len(data)) != size {
+		return io.ErrUnexpectedEOF
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.Settings.DryRun {
+		m.dryRunBytes += size
+		return nil
+	}
+	if m.Settings.Mode != 0 {
+		mode = m.Settings.Mode
+	} else if mode == 0 {
+		mode = os.ModePerm
+	}
+	if mtime.IsZero() {
+		mtime = time.Now()
+	}
+	if h := m.Settings.Hash; h != nil {
+		h.Reset()
+		h.Write(data)
+	}
+	if old := m.Files[filepath.Clean(dstfile)]; old != nil && m.Settings.Append {
+		data = append(append([]byte(nil), old.Data...), data...)
+	}
+	m.Files[filepath.Clean(dstfile)] = &File{Data: data, Mode: mode, ModTime: mtime}
+	if m.Settings.Progress != nil {
+		m.Settings.Progress(size, size)
+	}
+	return nil
+}
+
+func (m *MemHelper) putPath(srcfile string, wrap func(io.Reader) io.Reader, dstfile string) error {
+	fd, err := os.Open(srcfile)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+	info, err := fd.Stat()
+	if err != nil {
+		return err
+	}
+	var mtime time.Time
+	if m.Settings.PreserveTimes {
+		mtime = info.ModTime()
+	}
+	var r io.Reader = fd
+	size := info.Size()
+	if info.Mode()&os.ModeNamedPipe != 0 {
+		data, err := ioutil.ReadAll(fd)
+		if err != nil {
+			return err
+		}
+		r, size = bytes.NewReader(data), int64(len(data))
+	}
+	if wrap != nil {
+		r = wrap(r)
+	}
+	return m.put(r, size, dstfile, info.Mode().Perm(), mtime)
+}
+
+func (m *MemHelper) Copy(r io.Reader, size int64, dstfile string) error {
+	return m.put(r, size, dstfile, 0, time.Time{})
+}
+
+func (m *MemHelper) CopyPath(srcfile, dstfile string) error {
+	return m.putPath(srcfile, nil, dstfile)
+}
+
+func (m *MemHelper) CopyContext(ctx context.Context, r io.Reader, size int64, dstfile string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return m.Copy(r, size, dstfile)
+}
+
+func (m *MemHelper) CopyPathContext(ctx context.Context, srcfile, dstfile string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return m.CopyPath(srcfile, dstfile)
+}
+
+func (m *MemHelper) CopyWithTimes(r io.Reader, size int64, dstfile string, mtime, atime time.Time) error {
+	return m.put(r, size, dstfile, 0, mtime)
+}
+
+func (m *MemHelper) CopyBytes(data []byte, dstfile string) error {
+	return m.Copy(bytes.NewReader(data), int64(len(data)), dstfile)
+}
+
+func (m *MemHelper) CopyString(data, dstfile string) error {
+	return m.Copy(strings.NewReader(data), int64(len(data)), dstfile)
+}
+
+func (m *MemHelper) CopyStream(dstfile string) (io.WriteCloser, error) {
+	return &memStream{helper: m, dstfile: dstfile}, nil
+}
+
+type memStream struct {
+	bytes.Buffer
+	helper  *MemHelper
+	dstfile string
+}
+
+func (w *memStream) Close() error {
+	return w.helper.Copy(&w.Buffer, int64(w.Len()), w.dstfile)
+}
+
+func (m *MemHelper) CopyTo(r io.Reader, size int64, dstDir, name string) error {
+	return m.Copy(r, size, filepath.Join(dstDir, name))
+}
+
+func (m *MemHelper) CopyAuto(r io.Reader, dstfile string) error {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	return m.CopyBytes(data, dstfile)
+}
+
+func (m *MemHelper) CopyMulti(r io.ReaderAt, size int64, dstpaths []string) error {
+	var errs scp.ErrFiles
+	for _, dst := range dstpaths {
+		if err := m.Copy(io.NewSectionReader(r, 0, size), size, dst); err != nil {
+			errs = append(errs, &scp.ErrFile{Path: dst, Err: err})
+		}
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+func (m *MemHelper) MustCopy(r io.Reader, size int64, dstfile string) {
+	if err := m.Copy(r, size, dstfile); err != nil {
+		panic(err)
+	}
+}
+
+func (m *MemHelper) CopyPathWithReader(srcfile string, wrap func(io.Reader) io.Reader, dstfile string) error {
+	return m.putPath(srcfile, wrap, dstfile)
+}
+
+func (m *MemHelper) CopyTar(files map[string]io.Reader, sizes map[string]int64, dstDir string) error {
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		var mtime time.Time
+		if st, ok := files[name].(interface{ Stat() (os.FileInfo, error) }); ok && m.Settings.PreserveTimes {
+			if info, err := st.Stat(); err == nil {
+				mtime = info.ModTime()
+			}
+		}
+		if err := m.put(files[name], sizes[name], filepath.Join(dstDir, filepath.FromSlash(name)), 0644, mtime); err != nil {
+			return &scp.ErrFile{Path: name, Err: err}
+		}
+	}
+	return nil
+}
+
+func (m *MemHelper) CopyPathAs(srcfile, dstdir, dstname string) error {
+	if dstname == "" {
+		dstname = filepath.Base(srcfile)
+	}
+	return m.CopyPath(srcfile, filepath.Join(dstdir, dstname))
+}
+
+func (m *MemHelper) MustCopyPath(srcfile, dstfile string) {
+	if err := m.CopyPath(srcfile, dstfile); err != nil {
+		panic(err)
+	}
+}
+
+func (m *MemHelper) TryCopy(r io.Reader, size int64, dstfile string, trys int) error {
+	return m.Copy(r, size, dstfile)
+}
+
+func (m *MemHelper) TryCopyPath(srcfile, dstfile string, trys int) error {
+	return m.CopyPath(srcfile, dstfile)
+}
+
+// CopyDir record every regular file under srcdir as dstdir/base(srcdir)/...
+func (m *MemHelper) CopyDir(srcdir, dstdir string) error {
+	root := filepath.Dir(srcdir)
+	return filepath.Walk(srcdir, func(name string, info os.FileInfo, err error) error {
+		if err != nil || !info.Mode().IsRegular() {
+			return err
+		}
+		rel, err := filepath.Rel(root, name)
+		if err != nil {
+			return err
+		}
+		return m.putPath(name, nil, filepath.Join(dstdir, rel))
+	})
+}
+
+func (m *MemHelper) CopyDirParallel(srcdir, dstdir string, workers int) error {
+	var errs scp.ErrFiles
+	filepath.Walk(srcdir, func(name string, info os.FileInfo, err error) error {
+		if err == nil && info.Mode().IsRegular() {
+			rel, _ := filepath.Rel(srcdir, name)
+			err = m.putPath(name, nil, filepath.Join(dstdir, rel))
+		}
+		if err != nil {
+			errs = append(errs, &scp.ErrFile{Path: name, Err: err})
+		}
+		return nil
+	})
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+func (m *MemHelper) CopyFiles(srcfiles []string, dstdir string) error {
+	for _, name := range srcfiles {
+		if err := m.putPath(name, nil, filepath.Join(dstdir, filepath.Base(name))); err != nil {
+			return &scp.ErrFile{Path: name, Err: err}
+		}
+	}
+	return nil
+}
+
+func (m *MemHelper) CopyGlob(pattern, dstdir string) error {
+	matches, err := filepath.Glob(pattern)
+	if err != nil {
+		return err
+	}
+	if len(matches) == 0 {
+		return fmt.Errorf("no files matched %s", pattern)
+	}
+	return m.CopyFiles(matches, dstdir)
+}
+
+func (m *MemHelper) Fetch(remotePath string, w io.Writer) (int64, error) {
+	if m.Err != nil {
+		return 0, m.Err
+	}
+	f := m.File(remotePath)
+	if f == nil {
+		return 0, &scp.ErrAck{Msg: remotePath + ": No such file or directory"}
+	}
+	n, err := w.Write(f.Data)
+	return int64(n), err
+}
+
+func (m *MemHelper) CopyReaderAt(r io.ReaderAt, size int64, dstfile string) error {
+	return m.Copy(io.NewSectionReader(r, 0, size), size, dstfile)
+}
+
+func (m *MemHelper) TryCopyReaderAt(r io.ReaderAt, size int64, dstfile string, trys int) error {
+	return m.CopyReaderAt(r, size, dstfile)
+}
+
+func (m *MemHelper) VerifyBinarySafe(data []byte, dstfile string) error {
+	if m.Settings.Append {
+		return errors.New("verify need the remote file to hold only data, disable SetAppend")
+	}
+	return m.CopyAndVerify(bytes.NewReader(data), int64(len(data)), dstfile)
+}
+
+func (m *MemHelper) CopyAndVerify(r io.ReaderAt, size int64, dstfile string) error {
+	if m.Settings.Append {
+		return errors.New("verify need the remote file to hold only r, disable SetAppend")
+	}
+	if err := m.Copy(io.NewSectionReader(r, 0, size), size, dstfile); err != nil {
+		return err
+	}
+	f := m.File(dstfile)
+	if f == nil {
+		return nil
+	}
+	want, err := ioutil.ReadAll(io.NewSectionReader(r, 0, size))
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(want, f.Data) {
+		off := 0
+		for off < len(want) && off < len(f.Data) && want[off] == f.Data[off] {
+			off++
+		}
+		return scp.VerifyMismatchError{Path: dstfile, Offset: int64(off), Size: size, RemoteSize: int64(len(f.Data))}
+	}
+	return nil
+}
+
+func (m *MemHelper) Stat(remotePath string) (os.FileInfo, error) {
+	if m.Err != nil {
+		return nil, m.Err
+	}
+	f := m.File(remotePath)
+	if f == nil {
+		return nil, scp.ErrNotExist
+	}
+	return memFileInfo{name: filepath.Base(remotePath), file: f}, nil
+}
+
+func (m *MemHelper) FetchPath(srcfile, dstfile string) error {
+	if m.Err != nil {
+		return m.Err
+	}
+	f := m.File(srcfile)
+	if f == nil {
+		return &scp.ErrAck{Msg: srcfile + ": No such file or directory"}
+	}
+	if err := ioutil.WriteFile(dstfile, f.Data, f.Mode); err != nil || !m.Settings.PreserveTimes {
+		return err
+	}
+	return os.Chtimes(dstfile, f.ModTime, f.ModTime)
+}
+
+func (m *MemHelper) Sum() []byte {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.Settings.Hash == nil {
+		return nil
+	}
+	return m.Settings.Hash.Sum(nil)
+}
+
+// Ping fail with Err when set
+func (m *MemHelper) Ping() error {
+	return m.Err
+}
+
+// RemoteVersion a fixed OpenSSH version
+func (m *MemHelper) RemoteVersion() (string, error) {
+	return "OpenSSH_9.6p1", nil
+}
+
+func (m *MemHelper) Close() error {
+	m.Closed = true
+	return nil
+}
+
+func (m *MemHelper) SetLimitKB(kbs int) {
+	m.SetLimitKBps(kbs)
+}
+
+func (m *MemHelper) SetLimitKbps(kbps int) error {
+	if kbps < 0 {
+		return fmt.Errorf("negative bandwidth limit %d", kbps)
+	}
+	m.Settings.LimitKbps = kbps
+	return nil
+}
+
+func (m *MemHelper) SetLimitKBps(kBps int) error {
+	if kBps < 0 {
+		return fmt.Errorf("negative bandwidth limit %d", kBps)
+	}
+	return m.SetLimitKbps(kBps * 8)
+}
+
+func (m *MemHelper) SetGzipEnable(enable bool) {
+	if enable {
+		m.SetCompression(scp.Gzip, 0)
+	} else {
+		m.SetCompression(scp.None, 0)
+	}
+}
+
+func (m *MemHelper) SetCompression(c scp.Compression, level int) error {
+	m.Settings.Compression = c
+	m.Settings.CompressionLevel = level
+	return nil
+}
+
+func (m *MemHelper) SetFollowSymlinks(enable bool)  { m.Settings.FollowSymlinks = enable }
+func (m *MemHelper) SetContinueOnError(enable bool) { m.Settings.ContinueOnError = enable }
+func (m *MemHelper) SetPreserveTimes(enable bool)   { m.Settings.PreserveTimes = enable }
+func (m *MemHelper) SetProgressFunc(fn func(copied, total int64)) {
+	m.Settings.Progress = fn
+}
+func (m *MemHelper) SetBackoff(backoff scp.BackoffFunc)      { m.Settings.Backoff = backoff }
+func (m *MemHelper) SetMaxRetryDuration(d time.Duration)     { m.Settings.MaxRetryDuration = d }
+func (m *MemHelper) SetEnv(env map[string]string)            { m.Settings.Env = env }
+func (m *MemHelper) SetSkipIfIdentical(enable bool)          { m.Settings.SkipIfIdentical = enable }
+func (m *MemHelper) SetVerifyChecksum(enable bool)           { m.Settings.VerifyChecksum = enable }
+func (m *MemHelper) SetChecksumCommand(cmd string)           { m.Settings.ChecksumCommand = cmd }
+func (m *MemHelper) SetMode(mode os.FileMode)                { m.Settings.Mode = mode.Perm() }
+func (m *MemHelper) SetAtomic(enable bool)                   { m.Settings.Atomic = enable }
+func (m *MemHelper) SetLogger(logger scp.Logger)             { m.Settings.Logger = logger }
+func (m *MemHelper) SetMetrics(metrics scp.Metrics)          { m.Settings.Metrics = metrics }
+func (m *MemHelper) SetResume(enable bool)                   { m.Settings.Resume = enable }
+func (m *MemHelper) SetRateLimiter(limiter *scp.RateLimiter) { m.Settings.RateLimiter = limiter }
+func (m *MemHelper) SetKeepAlive(interval time.Duration)     { m.Settings.KeepAlive = interval }
+
+func (m *MemHelper) SetDryRun(enable bool) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.Settings.DryRun = enable
+	if enable {
+		m.dryRunBytes = 0
+	}
+}
+
+func (m *MemHelper) DryRunBytes() int64 {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.dryRunBytes
+}
+
+func (m *MemHelper) SetMkdirParents(enable bool)    { m.Settings.MkdirParents = enable }
+func (m *MemHelper) SetMkdirMode(mode os.FileMode)  { m.Settings.MkdirMode = mode.Perm() }
+func (m *MemHelper) SetGzipSuffix(suffix string)    { m.Settings.GzipSuffix = &suffix }
+func (m *MemHelper) SetGzipTransparent(enable bool) { m.Settings.GzipTransparent = enable }
+func (m *MemHelper) SetBufferSize(size int)         { m.Settings.BufferSize = size }
+func (m *MemHelper) SetTransferTimeout(d time.Duration) {
+	m.Settings.TransferTimeout = d
+}
+func (m *MemHelper) SetRemoteChmod(mode os.FileMode) { m.Settings.RemoteChmod = mode.Perm() }
+func (m *MemHelper) SetPreCommand(cmd string)        { m.Settings.PreCommand = cmd }
+func (m *MemHelper) SetPostCommand(cmd string)       { m.Settings.PostCommand = cmd }
+func (m *MemHelper) SetGzipMinRatio(ratio float64) {
+	m.Settings.GzipMinRatio = ratio
+}
+func (m *MemHelper) SetRemoteChown(user, group string) {
+	m.Settings.RemoteUser, m.Settings.RemoteGroup = user, group
+}
+func (m *MemHelper) SetJitter(enable bool)           { m.Settings.NoJitter = !enable }
+func (m *MemHelper) SetWireLog(w io.Writer)          { m.Settings.WireLog = w }
+func (m *MemHelper) SetGzipMinSize(size int64)       { m.Settings.GzipMinSize = size }
+func (m *MemHelper) SetEnvStrict(strict bool)        { m.Settings.EnvStrict = strict }
+func (m *MemHelper) SetMaxFileSize(size int64)       { m.Settings.MaxFileSize = size }
+func (m *MemHelper) SetCheckDiskSpace(enable bool)   { m.Settings.CheckDiskSpace = enable }
+func (m *MemHelper) SetDiskSpaceMargin(margin int64) { m.Settings.DiskSpaceMargin = margin }
+func (m *MemHelper) SetTempDir(dir string)           { m.Settings.TempDir = dir }
+func (m *MemHelper) SetTempPrefix(prefix string)     { m.Settings.TempPrefix = prefix }
+func (m *MemHelper) SetRemoteTempDir(dir string)     { m.Settings.RemoteTempDir = dir }
+func (m *MemHelper) SetAppend(enable bool)           { m.Settings.Append = enable }
+func (m *MemHelper) SetLocalLimit(bytesPerSec int)   { m.Settings.LocalLimit = bytesPerSec }
+func (m *MemHelper) SetOnReconnect(fn func(error))   { m.Settings.OnReconnect = fn }
+func (m *MemHelper) SetHash(h hash.Hash)             { m.Settings.Hash = h }
+
+// memFileInfo os.FileInfo of a recorded File
+type memFileInfo struct {
+	name string
+	file *File
+}
+
+func (fi memFileInfo) Name() string       { return fi.name }
+func (fi memFileInfo) Size() int64        { return int64(len(fi.file.Data)) }
+func (fi memFileInfo) Mode() os.FileMode  { return fi.file.Mode }
+func (fi memFileInfo) ModTime() time.Time { return fi.file.ModTime }
+func (fi memFileInfo) IsDir() bool        { return false }
+func (fi memFileInfo) Sys() interface{}   { return nil }
@@ -0,0 +1,493 @@
+package scptest
+
+import (
+	"bufio"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/glutwins/scp"
+	"golang.org/x/crypto/ssh"
+)
+
+// StartServer serve scp -t and scp -f over ssh on a random 127.0.0.1 port,
+// remote paths resolve under root. Other commands, e.g. stat, mv or tar, run
+// with sh -c in root with HOME set to root, so relative paths agree with the
+// scp ones while absolute paths reach the real filesystem. The password and
+// host key are generated per server and only the Dialer of addr log in, so
+// other local users can not run commands through it. cleanup stop the server and
+// close its connections.
+func StartServer(root string) (addr string, cleanup func(), err error) {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return "", nil, err
+	}
+	signer, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		return "", nil, err
+	}
+	secret := make([]byte, 16)
+	if _, err = rand.Read(secret); err != nil {
+		return "", nil, err
+	}
+	password := hex.EncodeToString(secret)
+	config := &ssh.ServerConfig{
+		PasswordCallback: func(meta ssh.ConnMetadata, pass []byte) (*ssh.Permissions, error) {
+			if meta.User() == testUser && subtle.ConstantTimeCompare(pass, []byte(password)) == 1 {
+				return nil, nil
+			}
+			return nil, errors.New("bad user or password")
+		},
+	}
+	config.AddHostKey(signer)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", nil, err
+	}
+	addr = l.Addr().String()
+	credentials.Store(addr, credential{password: password, hostKey: signer.PublicKey()})
+	s := &server{root: root, config: config, listener: l, conns: make(map[net.Conn]struct{})}
+	s.wg.Add(1)
+	go s.serve()
+	return addr, func() {
+		s.close()
+		credentials.Delete(addr)
+	}, nil
+}
+
+// testUser only user a StartServer accept
+const testUser = "test"
+
+// credential password and host key of a running StartServer
+type credential struct {
+	password string
+	hostKey  ssh.PublicKey
+}
+
+// credentials credential of every running StartServer by address
+var credentials sync.Map
+
+// Dialer scp.Dialer logging into a StartServer address with its password,
+// and checking its host key
+func Dialer(addr string) scp.Dialer {
+	d := scp.Dialer{SSHUser: testUser, SSHAddr: addr}
+	if v, ok := credentials.Load(addr); ok {
+		c := v.(credential)
+		d.SSHPass = c.password
+		d.HostKeyCallback = ssh.FixedHostKey(c.hostKey)
+	}
+	return d
+}
+
+type server struct {
+	root     string
+	config   *ssh.ServerConfig
+	listener net.Listener
+
+	lock   sync.Mutex
+	conns  map[net.Conn]struct{}
+	closed bool
+	wg     sync.WaitGroup
+}
+
+func (s *server) serve() {
+	defer s.wg.Done()
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		if !s.track(conn) {
+			conn.Close()
+			return
+		}
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			defer s.untrack(conn)
+			s.handleConn(conn)
+		}()
+	}
+}
+
+func (s *server) track(conn net.Conn) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.closed {
+		return false
+	}
+	s.conns[conn] = struct{}{}
+	return true
+}
+
+func (s *server) untrack(conn net.Conn) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.conns, conn)
+	conn.Close()
+}
+
+func (s *server) close() {
+	s.lock.Lock()
+	s.closed = true
+	s.listener.Close()
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.lock.Unlock()
+	s.wg.Wait()
+}
+
+func (s *server) handleConn(conn net.Conn) {
+	sconn, chans, reqs, err := ssh.NewServerConn(conn, s.config)
+	if err != nil {
+		return
+	}
+	defer sconn.Close()
+	go ssh.DiscardRequests(reqs)
+
+	for nc := range chans {
+		if nc.ChannelType() != "session" {
+			nc.Reject(ssh.UnknownChannelType, "only session channels are served")
+			continue
+		}
+		ch, creqs, err := nc.Accept()
+		if err != nil {
+			continue
+		}
+		go s.handleSession(ch, creqs)
+	}
+}
+
+func (s *server) handleSession(ch ssh.Channel, reqs <-chan *ssh.Request) {
+	defer ch.Close()
+	for req := range reqs {
+		switch req.Type {
+		case "env":
+			req.Reply(true, nil)
+		case "exec":
+			if len(req.Payload) < 4 || int(binary.BigEndian.Uint32(req.Payload)) != len(req.Payload)-4 {
+				req.Reply(false, nil)
+				continue
+			}
+			req.Reply(true, nil)
+			go ssh.DiscardRequests(reqs)
+
+			status := s.exec(ch, string(req.Payload[4:]))
+			payload := make([]byte, 4)
+			binary.BigEndian.PutUint32(payload, status)
+			ch.SendRequest("exit-status", false, payload)
+			return
+		default:
+			if req.WantReply {
+				req.Reply(false, nil)
+			}
+		}
+	}
+}
+
+// exec run cmd on ch and return its exit status
+func (s *server) exec(ch ssh.Channel, cmd string) uint32 {
+	args, ok := shellWords(cmd)
+	if !ok {
+		fmt.Fprintf(ch.Stderr(), "sh: unterminated quote in %s\n", cmd)
+		return 2
+	}
+	if len(args) == 0 || args[0] != "scp" {
+		return s.shell(ch, cmd)
+	}
+
+	var sink, source, preserve bool
+	var target string
+	for i := 1; i < len(args); i++ {
+		switch a := args[i]; {
+		case a == "-t":
+			sink = true
+		case a == "-f":
+			source = true
+		case a == "-p":
+			preserve = true
+		case a == "-l" || a == "-P":
+			i++
+		case strings.HasPrefix(a, "-"):
+		default:
+			target = a
+		}
+	}
+
+	switch {
+	case sink && target != "":
+		return s.sink(ch, s.local(target))
+	case source && target != "":
+		return s.source(ch, s.local(target), target, preserve)
+	}
+	fmt.Fprintln(ch.Stderr(), "usage: scp -t|-f path")
+	return 1
+}
+
+// shell run cmd with sh -c in root, wired to ch
+func (s *server) shell(ch ssh.Channel, cmd string) uint32 {
+	c := exec.Command("sh", "-c", cmd)
+	c.Dir = s.root
+	c.Env = append(os.Environ(), "HOME="+s.root)
+	c.Stdin = ch
+	c.Stdout = ch
+	c.Stderr = ch.Stderr()
+	err := c.Run()
+	if eerr, ok := err.(*exec.ExitError); ok {
+		return uint32(eerr.ExitCode())
+	} else if err != nil {
+		fmt.Fprintf(ch.Stderr(), "sh: %s\n", err.Error())
+		return 127
+	}
+	return 0
+}
+
+// shellWords split cmd into words like sh, with single and double quotes and
+// backslash escapes, ok is false on an unterminated quote
+func shellWords(cmd string) (words []string, ok bool) {
+	var word strings.Builder
+	inWord := false
+	var quote rune
+	escaped := false
+	for _, r := range cmd {
+		switch {
+		case escaped:
+			word.WriteRune(r)
+			escaped = false
+		case quote == '\'':
+			if r == '\'' {
+				quote = 0
+			} else {
+				word.WriteRune(r)
+			}
+		case r == '\\':
+			escaped, inWord = true, true
+		case quote == '"':
+			if r == '"' {
+				quote = 0
+			} else {
+				word.WriteRune(r)
+			}
+		case r == '\'' || r == '"':
+			quote, inWord = r, true
+		case r == ' ' || r == '\t' || r == '\n':
+			if inWord {
+				words = append(words, word.String())
+				word.Reset()
+				inWord = false
+			}
+		default:
+			word.WriteRune(r)
+			inWord = true
+		}
+	}
+	if quote != 0 || escaped {
+		return nil, false
+	}
+	if inWord {
+		words = append(words, word.String())
+	}
+	return words, true
+}
+
+// local map the remote path p under root
+func (s *server) local(p string) string {
+	return filepath.Join(s.root, filepath.FromSlash(path.Clean("/"+p)))
+}
+
+// sink receive records into target like scp -t
+func (s *server) sink(ch ssh.Channel, target string) uint32 {
+	r := bufio.NewReader(ch)
+	dirs := []string{target}
+	var status uint32
+	var times []time.Time
+
+	// dest where a record named name land, the target itself when it is not
+	// an existing directory
+	dest := func(name string) string {
+		cur := dirs[len(dirs)-1]
+		if len(dirs) == 1 {
+			if fi, err := os.Stat(cur); err != nil || !fi.IsDir() {
+				return cur
+			}
+		}
+		return filepath.Join(cur, name)
+	}
+	fail := func(err error) {
+		status = 1
+		fmt.Fprintf(ch, "\x01scp: %s\n", err.Error())
+	}
+
+	ch.Write([]byte{0})
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return status
+		}
+		line = strings.TrimSuffix(line, "\n")
+		if line == "" {
+			fail(fmt.Errorf("empty record"))
+			continue
+		}
+
+		switch line[0] {
+		case 'T':
+			var mtime, atime int64
+			if _, err := fmt.Sscanf(line, "T%d 0 %d 0", &mtime, &atime); err != nil {
+				fail(fmt.Errorf("bad times record %q", line))
+				continue
+			}
+			times = []time.Time{time.Unix(atime, 0), time.Unix(mtime, 0)}
+			ch.Write([]byte{0})
+		case 'C', 'D':
+			mode, size, name, err := parseRecord(line)
+			if err != nil {
+				fail(err)
+				continue
+			}
+			dst := dest(name)
+			if line[0] == 'D' {
+				if err = os.MkdirAll(dst, mode); err != nil {
+					fail(err)
+					continue
+				}
+				if times != nil {
+					os.Chtimes(dst, times[0], times[1])
+					times = nil
+				}
+				dirs = append(dirs, dst)
+				ch.Write([]byte{0})
+				continue
+			}
+
+			if err = s.receive(ch, r, dst, mode, size); err != nil {
+				fail(err)
+				continue
+			}
+			if times != nil {
+				os.Chtimes(dst, times[0], times[1])
+				times = nil
+			}
+			ch.Write([]byte{0})
+		case 'E':
+			if len(dirs) > 1 {
+				dirs = dirs[:len(dirs)-1]
+			}
+			ch.Write([]byte{0})
+		default:
+			fmt.Fprintf(ch, "\x02scp: protocol error: unexpected %q\n", line)
+			return 1
+		}
+	}
+}
+
+// receive ack a C record then write its size bytes body and end byte to dst
+func (s *server) receive(ch ssh.Channel, r *bufio.Reader, dst string, mode os.FileMode, size int64) error {
+	f, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	ch.Write([]byte{0})
+	if _, err = io.CopyN(f, r, size); err != nil {
+		return err
+	}
+	if b, err := r.ReadByte(); err != nil {
+		return err
+	} else if b != 0 {
+		return fmt.Errorf("missing end of file byte")
+	}
+	if err = f.Chmod(mode); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// source send p like scp -f, name is the remote path for error messages
+func (s *server) source(ch ssh.Channel, p, name string, preserve bool) uint32 {
+	r := bufio.NewReader(ch)
+	if err := readAck(r); err != nil {
+		return 1
+	}
+
+	f, err := os.Open(p)
+	if err != nil {
+		fmt.Fprintf(ch, "\x01scp: %s: No such file or directory\n", name)
+		return 1
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil || !fi.Mode().IsRegular() {
+		fmt.Fprintf(ch, "\x01scp: %s: not a regular file\n", name)
+		return 1
+	}
+
+	if preserve {
+		fmt.Fprintf(ch, "T%d 0 %d 0\n", fi.ModTime().Unix(), fi.ModTime().Unix())
+		if err = readAck(r); err != nil {
+			return 1
+		}
+	}
+	fmt.Fprintf(ch, "C%04o %d %s\n", fi.Mode().Perm(), fi.Size(), fi.Name())
+	if err = readAck(r); err != nil {
+		return 1
+	}
+	if _, err = io.Copy(ch, f); err != nil {
+		return 1
+	}
+	ch.Write([]byte{0})
+	if err = readAck(r); err != nil {
+		return 1
+	}
+	return 0
+}
+
+// parseRecord split a C or D record into mode, size and name
+func parseRecord(line string) (os.FileMode, int64, string, error) {
+	parts := strings.SplitN(line[1:], " ", 3)
+	if len(parts) != 3 {
+		return 0, 0, "", fmt.Errorf("bad record %q", line)
+	}
+	mode, err := strconv.ParseUint(parts[0], 8, 32)
+	if err != nil {
+		return 0, 0, "", fmt.Errorf("bad mode in %q", line)
+	}
+	size, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil || size < 0 {
+		return 0, 0, "", fmt.Errorf("bad size in %q", line)
+	}
+	if parts[2] == "" || strings.Contains(parts[2], "/") || parts[2] == ".." {
+		return 0, 0, "", fmt.Errorf("bad name in %q", line)
+	}
+	return os.FileMode(mode).Perm(), size, parts[2], nil
+}
+
+// readAck read a status byte, with its message when not zero
+func readAck(r *bufio.Reader) error {
+	b, err := r.ReadByte()
+	if err != nil {
+		return err
+	}
+	if b == 0 {
+		return nil
+	}
+	msg, _ := r.ReadString('\n')
+	return fmt.Errorf("%s", strings.TrimSpace(msg))
+}
@@ -0,0 +1,268 @@
+package scp
+
+import (
+	"context"
+	"hash"
+	"io"
+	"os"
+	"path"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+// NewSftpHelper New Helper transferring over the sftp subsystem instead of
+// the scp command, compression, retry and other options behave the same
+func NewSftpHelper(dialer *Dialer) Helper {
+	s := newHelperDelegate(dialer)
+	s.sftp = true
+	return s
+}
+
+// sftpClient start the sftp subsystem over a new session
+func (s *scpHelperDelegate) sftpClient(ctx context.Context) (*ssh.Session, *sftp.Client, error) {
+	session, err := s.newSessionContext(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	w, err := session.StdinPipe()
+	if err != nil {
+		session.Close()
+		return nil, nil, err
+	}
+	r, err := session.StdoutPipe()
+	if err != nil {
+		session.Close()
+		return nil, nil, err
+	}
+	if err = session.RequestSubsystem("sftp"); err != nil {
+		session.Close()
+		return nil, nil, err
+	}
+	client, err := sftp.NewClientPipe(r, w)
+	if err != nil {
+		session.Close()
+		return nil, nil, err
+	}
+	return session, client, nil
+}
+
+func (s *scpHelperDelegate) sftpUpload(ctx context.Context, r io.Reader, size int64, mode os.FileMode, dir, name string, times *fileTimes) error {
+	snk, err := s.openSftpSink(ctx, dir)
+	if err != nil {
+		return err
+	}
+	defer snk.close()
+	stop := watchContext(ctx, snk.session)
+	defer stop()
+	snk.hash = s.hash
+
+	if times != nil {
+		if err = snk.times(times); err != nil {
+			return err
+		}
+	}
+	if err = snk.file(mode, size, name, r); err != nil {
+		return err
+	}
+	return snk.wait()
+}
+
+func (s *scpHelperDelegate) sftpAppend(ctx context.Context, r io.Reader, dstfile string) error {
+	session, client, err := s.sftpClient(ctx)
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+	defer client.Close()
+	stop := watchContext(ctx, session)
+	defer stop()
+
+	f, err := client.OpenFile(dstfile, os.O_WRONLY|os.O_APPEND|os.O_CREATE)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(f, r); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func (s *scpHelperDelegate) sftpFetch(srcfile string, open func(os.FileMode, int64, string, *fileTimes) (io.Writer, error)) (int64, error) {
+	session, client, err := s.sftpClient(context.Background())
+	if err != nil {
+		return 0, err
+	}
+	defer session.Close()
+	defer client.Close()
+
+	f, err := client.Open(srcfile)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	var times *fileTimes
+	if s.preserveTimes {
+		times = &fileTimes{mtime: info.ModTime(), atime: info.ModTime()}
+	}
+	w, err := open(info.Mode().Perm(), info.Size(), info.Name(), times)
+	if err != nil {
+		return 0, err
+	}
+	return io.Copy(w, f)
+}
+
+func (s *scpHelperDelegate) sftpStat(remotePath string) (os.FileInfo, error) {
+	session, client, err := s.sftpClient(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	defer session.Close()
+	defer client.Close()
+
+	info, err := client.Stat(remotePath)
+	if os.IsNotExist(err) {
+		return nil, ErrNotExist
+	}
+	return info, err
+}
+
+func (s *scpHelperDelegate) openSftpSink(ctx context.Context, dstdir string) (*sftpSink, error) {
+	session, client, err := s.sftpClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &sftpSink{session: session, client: client, dirs: []string{dstdir}, progress: s.progress}, nil
+}
+
+// sftpSink emulate the records of the scp sink with sftp operations, so
+// the same walkers drive both backends
+type sftpSink struct {
+	session  *ssh.Session
+	client   *sftp.Client
+	dirs     []string
+	pending  *fileTimes
+	progress func(copied, total int64)
+	hash     hash.Hash
+}
+
+// target resolve name like "scp -t" does: inside the destination when it is
+// an existing directory, else the destination itself
+func (s *sftpSink) target(name string) string {
+	top := s.dirs[len(s.dirs)-1]
+	if len(s.dirs) > 1 {
+		return path.Join(top, name)
+	}
+	if info, err := s.client.Stat(top); err == nil && info.IsDir() {
+		return path.Join(top, name)
+	}
+	return top
+}
+
+func (s *sftpSink) times(t *fileTimes) error {
+	s.pending = t
+	return nil
+}
+
+// applyTimes set the pending T record on p
+func (s *sftpSink) applyTimes(p string) error {
+	t := s.pending
+	s.pending = nil
+	if t == nil {
+		return nil
+	}
+	return s.client.Chtimes(p, t.atime, t.mtime)
+}
+
+func (s *sftpSink) dir(mode os.FileMode, name string) error {
+	p := s.target(name)
+	if info, err := s.client.Stat(p); err != nil || !info.IsDir() {
+		if err = s.client.Mkdir(p); err != nil {
+			return sftpAck(err)
+		}
+	}
+	if err := s.client.Chmod(p, mode); err != nil {
+		return sftpAck(err)
+	}
+	if err := s.applyTimes(p); err != nil {
+		return sftpAck(err)
+	}
+	s.dirs = append(s.dirs, p)
+	return nil
+}
+
+func (s *sftpSink) file(mode os.FileMode, size int64, name string, contents io.Reader) error {
+	p := s.target(name)
+	f, err := s.client.OpenFile(p, os.O_WRONLY|os.O_CREATE|os.O_TRUNC)
+	if err != nil {
+		return sftpAck(err)
+	}
+
+	src := contents
+	var pr *progressReader
+	if s.progress != nil {
+		pr = &progressReader{r: contents, fn: s.progress, total: size}
+		contents = pr
+	}
+	body := io.LimitReader(contents, size)
+	if s.hash != nil {
+		body = io.TeeReader(body, s.hash)
+	}
+	written, err := io.Copy(f, body)
+	if err == nil && written < size {
+		err = SizeMismatchError{Size: size, Actual: written}
+	} else if err == nil {
+		err = checkDrained(src, size)
+	}
+	if _, ok := err.(SizeMismatchError); ok {
+		// do not leave a truncated file behind
+		f.Close()
+		s.client.Remove(p)
+		return err
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil && written < size {
+		return PartialTransferError{Written: written, Total: size, Err: err}
+	} else if err != nil {
+		return err
+	}
+	if err = s.client.Chmod(p, mode); err != nil {
+		return sftpAck(err)
+	}
+	if err = s.applyTimes(p); err != nil {
+		return sftpAck(err)
+	}
+	if pr != nil {
+		pr.finish()
+	}
+	return nil
+}
+
+func (s *sftpSink) end() error {
+	if len(s.dirs) > 1 {
+		s.dirs = s.dirs[:len(s.dirs)-1]
+	}
+	return nil
+}
+
+func (s *sftpSink) wait() error {
+	return s.client.Close()
+}
+
+func (s *sftpSink) close() error {
+	s.client.Close()
+	return s.session.Close()
+}
+
+// sftpAck report a per-file sftp failure the way scp sink would, so walkers
+// may skip the file and go on
+func sftpAck(err error) error {
+	return &ErrAck{Msg: err.Error()}
+}
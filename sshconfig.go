@@ -0,0 +1,163 @@
+package scp
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/kevinburke/ssh_config"
+)
+
+// ErrUnknownAlias no Host block of the ssh config set anything for Alias
+type ErrUnknownAlias struct {
+	Alias string
+}
+
+func (err ErrUnknownAlias) Error() string {
+	return fmt.Sprintf("ssh config has no Host entry for %q", err.Alias)
+}
+
+// maxJumpDepth ProxyJump hops resolved through the config, beyond it the
+// config is assumed to loop
+const maxJumpDepth = 8
+
+// NewDialerFromSSHConfig build a Dialer from the Host entry of alias in
+// ~/.ssh/config and /etc/ssh/ssh_config, Include directives followed. It
+// read HostName, Port, User, IdentityFile, UserKnownHostsFile and ProxyJump,
+// whose hops are resolved the same way. Without IdentityFile the ssh-agent
+// is used. Only ~ is expanded in paths.
+func NewDialerFromSSHConfig(alias string) (*Dialer, error) {
+	return dialerFromSSHConfig(ssh_config.DefaultUserSettings, alias, 0)
+}
+
+// sshConfigSource lookup of ssh config values, a *ssh_config.UserSettings
+type sshConfigSource interface {
+	GetStrict(alias, key string) (string, error)
+	GetAllStrict(alias, key string) ([]string, error)
+}
+
+func dialerFromSSHConfig(settings sshConfigSource, alias string, depth int) (*Dialer, error) {
+	if depth > maxJumpDepth {
+		return nil, fmt.Errorf("ssh config: ProxyJump of %q nest more than %d hops", alias, maxJumpDepth)
+	}
+	get := func(key string) (string, error) {
+		v, err := settings.GetStrict(alias, key)
+		if err != nil {
+			return "", fmt.Errorf("ssh config: %s", err.Error())
+		}
+		return v, nil
+	}
+
+	hostname, err := get("HostName")
+	if err != nil {
+		return nil, err
+	}
+	port, err := get("Port")
+	if err != nil {
+		return nil, err
+	}
+	user, err := get("User")
+	if err != nil {
+		return nil, err
+	}
+	jump, err := get("ProxyJump")
+	if err != nil {
+		return nil, err
+	}
+	if hostname == "" && user == "" && jump == "" && (port == "" || port == "22") {
+		return nil, ErrUnknownAlias{Alias: alias}
+	}
+	if hostname == "" {
+		hostname = alias
+	}
+	if port == "" {
+		port = defaultPort
+	}
+	if user == "" {
+		user = os.Getenv("USER")
+	}
+
+	d := &Dialer{SSHUser: user, SSHAddr: net.JoinHostPort(hostname, port)}
+	files, err := settings.GetAllStrict(alias, "IdentityFile")
+	if err != nil {
+		return nil, fmt.Errorf("ssh config: %s", err.Error())
+	}
+	for _, f := range files {
+		// the default identity is listed even when it does not exist
+		if f = expandHome(f); fileExists(f) {
+			d.SSHFile = f
+			break
+		}
+	}
+	d.SSHUseAgent = d.SSHFile == ""
+
+	known, err := settings.GetAllStrict(alias, "UserKnownHostsFile")
+	if err != nil {
+		return nil, fmt.Errorf("ssh config: %s", err.Error())
+	}
+	if len(known) > 0 {
+		// the value may list several files, the first is used
+		if fields := strings.Fields(known[0]); len(fields) > 0 {
+			d.KnownHostsFile = expandHome(fields[0])
+		}
+	}
+
+	if jump != "" && !strings.EqualFold(jump, "none") {
+		for _, hop := range strings.Split(jump, ",") {
+			hd, err := jumpDialer(settings, strings.TrimSpace(hop), depth)
+			if err != nil {
+				return nil, err
+			}
+			d.Jump = append(d.Jump, *hd)
+		}
+	}
+	return d, nil
+}
+
+// jumpDialer resolve a [user@]host[:port] ProxyJump hop, host being an alias
+// when the config know it
+func jumpDialer(settings sshConfigSource, hop string, depth int) (*Dialer, error) {
+	var user string
+	if i := strings.LastIndex(hop, "@"); i >= 0 {
+		user, hop = hop[:i], hop[i+1:]
+	}
+	host, port, err := net.SplitHostPort(hop)
+	if err != nil {
+		host, port = strings.Trim(hop, "[]"), ""
+	}
+
+	d, err := dialerFromSSHConfig(settings, host, depth+1)
+	if _, ok := err.(ErrUnknownAlias); ok {
+		d, err = &Dialer{SSHUser: os.Getenv("USER"), SSHAddr: net.JoinHostPort(host, defaultPort), SSHUseAgent: true}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if user != "" {
+		d.SSHUser = user
+	}
+	if port != "" {
+		h, _, _ := net.SplitHostPort(d.SSHAddr)
+		d.SSHAddr = net.JoinHostPort(h, port)
+	}
+	return d, nil
+}
+
+// expandHome replace a leading ~ with the home directory
+func expandHome(p string) string {
+	if p != "~" && !strings.HasPrefix(p, "~/") {
+		return p
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return p
+	}
+	return filepath.Join(home, p[1:])
+}
+
+func fileExists(p string) bool {
+	_, err := os.Stat(p)
+	return err == nil
+}
@@ -0,0 +1,75 @@
+package scp
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/kevinburke/ssh_config"
+)
+
+// decodedConfig sshConfigSource over a single decoded config
+type decodedConfig struct {
+	*ssh_config.Config
+}
+
+func (c decodedConfig) GetStrict(alias, key string) (string, error) {
+	return c.Get(alias, key)
+}
+
+func (c decodedConfig) GetAllStrict(alias, key string) ([]string, error) {
+	return c.GetAll(alias, key)
+}
+
+func TestDialerFromSSHConfig(t *testing.T) {
+	dir := t.TempDir()
+	key := filepath.Join(dir, "id_ed25519")
+	if err := ioutil.WriteFile(key, []byte("key"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	config, err := ssh_config.Decode(strings.NewReader(`
+Host web
+  HostName 10.0.0.5
+  Port 2222
+  User deploy
+  IdentityFile ` + key + `
+  UserKnownHostsFile /etc/known_hosts_web /etc/other
+  ProxyJump bastion,ops@10.0.0.9:2200
+
+Host bastion
+  HostName bastion.example.com
+  User jump
+
+Host loop
+  ProxyJump loop
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	settings := decodedConfig{config}
+
+	d, err := dialerFromSSHConfig(settings, "web", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.SSHAddr != "10.0.0.5:2222" || d.SSHUser != "deploy" || d.SSHFile != key || d.SSHUseAgent || d.KnownHostsFile != "/etc/known_hosts_web" {
+		t.Fatalf("got %+v", d)
+	}
+	if len(d.Jump) != 2 {
+		t.Fatalf("got %d jump hosts, want 2", len(d.Jump))
+	}
+	if j := d.Jump[0]; j.SSHAddr != "bastion.example.com:22" || j.SSHUser != "jump" || !j.SSHUseAgent {
+		t.Fatalf("got first hop %+v", j)
+	}
+	if j := d.Jump[1]; j.SSHAddr != "10.0.0.9:2200" || j.SSHUser != "ops" {
+		t.Fatalf("got second hop %+v", j)
+	}
+
+	if _, err = dialerFromSSHConfig(settings, "nowhere", 0); err != (ErrUnknownAlias{Alias: "nowhere"}) {
+		t.Fatalf("got %v, want ErrUnknownAlias", err)
+	}
+	if _, err = dialerFromSSHConfig(settings, "loop", 0); err == nil {
+		t.Fatal("ProxyJump loop resolved")
+	}
+}
@@ -0,0 +1,168 @@
+package scp
+
+import (
+	"archive/tar"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// defaultTarMode mode of files extracted by CopyTar, unless SetMode pinned another one
+const defaultTarMode = 0644
+
+// CopyTar stream files as a tar archive into "tar -x -C dstDir" over a single
+// session, much faster than one scp record per file for many small files.
+// Names are slash separated paths relative to dstDir, their parents are
+// created by tar, sizes give the length of every file. The archive is gzip
+// or zstd compressed with the helper compression. With SetPreserveTimes a
+// reader with a Stat method, such as *os.File, keep its modification time,
+// other files get the time of the transfer. A failure may leave the files
+// before it extracted.
+func (s *scpHelperDelegate) CopyTar(files map[string]io.Reader, sizes map[string]int64, dstDir string) error {
+	names := make([]string, 0, len(files))
+	for name := range files {
+		if _, ok := sizes[name]; !ok {
+			return &ErrFile{Path: name, Err: errors.New("no size given")}
+		}
+		if clean := path.Clean(name); clean == "." || clean == ".." || path.IsAbs(clean) || strings.HasPrefix(clean, "../") {
+			return &ErrFile{Path: name, Err: errors.New("not a relative path inside the destination")}
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	mode := s.mode
+	if mode == 0 {
+		mode = defaultTarMode
+	}
+	if s.dryRun {
+		snk := s.dryRunSink(dstDir)
+		for _, name := range names {
+			snk.file(mode, sizes[name], path.Clean(name), files[name])
+		}
+		return nil
+	}
+
+	ctx := context.Background()
+	tctx, cancel := s.transferContext(ctx)
+	defer cancel()
+	err := s.hook(tctx, s.preCommand)
+	if err == nil {
+		err = s.sendTar(tctx, names, files, sizes, mode, dstDir)
+	}
+	if err == nil {
+		err = s.hook(tctx, s.postCommand)
+	}
+	return s.expired(ctx, err)
+}
+
+// sendTar pipe the archive of names into the remote tar
+func (s *scpHelperDelegate) sendTar(ctx context.Context, names []string, files map[string]io.Reader, sizes map[string]int64, mode os.FileMode, dstDir string) (err error) {
+	var total int64
+	for _, name := range names {
+		total += sizes[name]
+	}
+	s.metrics.OnTransferStart()
+	start := time.Now()
+	defer func() {
+		if err != nil {
+			total = 0
+		}
+		s.metrics.OnTransferEnd(total, time.Since(start), err)
+	}()
+
+	if err = s.makeParents(ctx, dstDir); err != nil {
+		return err
+	}
+	cmd := fmt.Sprintf("tar -x -C %s", shellQuote(dstDir))
+	switch s.compression {
+	case None:
+	case Gzip:
+		cmd = fmt.Sprintf("tar -xz -C %s", shellQuote(dstDir))
+	default:
+		cmd = s.compression.decompressCmd() + " | " + cmd
+	}
+
+	pr, pw := io.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		err := s.writeTar(pw, names, files, sizes, mode)
+		pw.CloseWithError(err)
+		done <- err
+	}()
+	err = s.pipe(ctx, s.limit(ctx, pr), cmd)
+	// unblock the writer when the remote tar exited early
+	pr.Close()
+	if werr := <-done; werr != nil && !errors.Is(werr, io.ErrClosedPipe) {
+		return werr
+	}
+	return err
+}
+
+// statter reader knowing its file info, such as *os.File
+type statter interface {
+	Stat() (os.FileInfo, error)
+}
+
+// writeTar write the archive of names to w, compressed with the helper
+// compression
+func (s *scpHelperDelegate) writeTar(w io.Writer, names []string, files map[string]io.Reader, sizes map[string]int64, mode os.FileMode) error {
+	var zw io.WriteCloser
+	if s.compression != None {
+		var err error
+		if zw, err = s.compression.newWriter(w, s.level); err != nil {
+			return err
+		}
+		w = zw
+	}
+	tw := tar.NewWriter(w)
+	now := time.Now()
+	for _, name := range names {
+		size := sizes[name]
+		src := files[name]
+		hdr := &tar.Header{Typeflag: tar.TypeReg, Name: path.Clean(name), Size: size, Mode: int64(mode.Perm()), ModTime: now}
+		if st, ok := src.(statter); ok && s.preserveTimes {
+			info, err := st.Stat()
+			if err != nil {
+				return &ErrFile{Path: name, Err: err}
+			}
+			hdr.ModTime = info.ModTime()
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+
+		r := src
+		var p *progressReader
+		if s.progress != nil {
+			p = &progressReader{r: src, fn: s.progress, total: size}
+			r = p
+		}
+		written, err := copyBuffer(tw, io.LimitReader(r, size), s.bufferSize)
+		if err != nil {
+			return &ErrFile{Path: name, Err: err}
+		}
+		if written < size {
+			return &ErrFile{Path: name, Err: SizeMismatchError{Size: size, Actual: written}}
+		}
+		if err = checkDrained(src, size); err != nil {
+			return &ErrFile{Path: name, Err: err}
+		}
+		if p != nil {
+			p.finish()
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	if zw != nil {
+		return zw.Close()
+	}
+	return nil
+}
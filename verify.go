@@ -0,0 +1,196 @@
+package scp
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+)
+
+// VerifyMismatchError file read back from Path differ from the source at
+// Offset, Size and RemoteSize are the source and remote lengths
+type VerifyMismatchError struct {
+	Path       string
+	Offset     int64
+	Size       int64
+	RemoteSize int64
+}
+
+func (err VerifyMismatchError) Error() string {
+	if err.Size != err.RemoteSize {
+		return fmt.Sprintf("verify %s: remote has %d bytes, expect %d", err.Path, err.RemoteSize, err.Size)
+	}
+	return fmt.Sprintf("verify %s: content differ at offset %d", err.Path, err.Offset)
+}
+
+// CopyAndVerify copy size bytes of r to dstfile, then fetch dstfile back and
+// compare it with r chunk by chunk. The remote must hold the plain content,
+// so compression is only allowed with SetGzipTransparent, and exactly r, so
+// SetAppend is rejected.
+func (s *scpHelperDelegate) CopyAndVerify(r io.ReaderAt, size int64, dstfile string) error {
+	if s.compression != None && !s.transparent {
+		return errors.New("verify need the plain content on the remote, use SetGzipTransparent with compression")
+	}
+	if s.append {
+		return errors.New("verify need the remote file to hold only r, disable SetAppend")
+	}
+	if err := s.CopyContext(context.Background(), io.NewSectionReader(r, 0, size), size, dstfile); err != nil {
+		return err
+	}
+	if s.dryRun {
+		return nil
+	}
+
+	cmp := &compareWriter{want: r, size: size, diff: -1}
+	n, err := s.Fetch(dstfile, cmp)
+	if err != nil {
+		return err
+	}
+	if cmp.diff < 0 && n != size {
+		cmp.diff = n
+		if size < n {
+			cmp.diff = size
+		}
+	}
+	if cmp.diff >= 0 {
+		return VerifyMismatchError{Path: dstfile, Offset: cmp.diff, Size: size, RemoteSize: n}
+	}
+	return nil
+}
+
+// compareWriter compare what is written with want, recording the offset of
+// the first difference
+type compareWriter struct {
+	want io.ReaderAt
+	size int64
+	off  int64
+	// diff first differing offset, -1 while equal
+	diff int64
+	buf  []byte
+}
+
+func (w *compareWriter) Write(p []byte) (int, error) {
+	if w.diff < 0 {
+		if cap(w.buf) < len(p) {
+			w.buf = make([]byte, len(p))
+		}
+		buf := w.buf[:len(p)]
+		m := 0
+		if w.off < w.size {
+			if int64(len(buf)) > w.size-w.off {
+				buf = buf[:w.size-w.off]
+			}
+			var err error
+			if m, err = w.want.ReadAt(buf, w.off); err != nil && err != io.EOF {
+				return 0, err
+			}
+		}
+		if i := firstDiff(p[:m], buf[:m]); i >= 0 {
+			w.diff = w.off + int64(i)
+		} else if m < len(p) {
+			w.diff = w.off + int64(m)
+		}
+	}
+	w.off += int64(len(p))
+	return len(p), nil
+}
+
+// firstDiff index of the first differing byte of a and b of same length, -1 when equal
+func firstDiff(a, b []byte) int {
+	if bytes.Equal(a, b) {
+		return -1
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return i
+		}
+	}
+	return -1
+}
+
+// VerifyBinarySafe upload data through the configured pipeline, compression
+// included, fetch it back and check it is byte exact, failing with
+// VerifyMismatchError. Empty data use a sample of every byte value, line
+// endings and random bytes. A compressed file of a previous run is removed
+// first, the uploaded file is left in place. SetAppend is rejected.
+func (s *scpHelperDelegate) VerifyBinarySafe(data []byte, dstfile string) error {
+	if s.append {
+		return errors.New("verify need the remote file to hold only data, disable SetAppend")
+	}
+	if len(data) == 0 {
+		var err error
+		if data, err = binarySample(); err != nil {
+			return err
+		}
+	}
+	// compression fall back to the plain name under the min ratio, so a
+	// compressed file left by an earlier run must not be taken for this one
+	suffixed := s.compressing(int64(len(data))) && !s.transparent
+	if suffixed && !s.dryRun {
+		if err := s.run(context.Background(), "rm -f -- "+shellQuote(s.compressedName(dstfile))); err != nil {
+			return err
+		}
+	}
+	if err := s.CopyBytes(data, dstfile); err != nil {
+		return err
+	}
+	if s.dryRun {
+		return nil
+	}
+
+	remote, compressed := dstfile, false
+	if suffixed {
+		if _, err := s.Stat(s.compressedName(dstfile)); err == nil {
+			remote, compressed = s.compressedName(dstfile), true
+		}
+	}
+	var buf bytes.Buffer
+	if _, err := s.Fetch(remote, &buf); err != nil {
+		return err
+	}
+	got := buf.Bytes()
+	if compressed {
+		zr, err := s.compression.newReader(&buf)
+		if err != nil {
+			return err
+		}
+		defer zr.Close()
+		if got, err = ioutil.ReadAll(zr); err != nil {
+			return err
+		}
+	}
+
+	size, remoteSize := int64(len(data)), int64(len(got))
+	n := len(data)
+	if len(got) < n {
+		n = len(got)
+	}
+	if i := firstDiff(data[:n], got[:n]); i >= 0 {
+		return VerifyMismatchError{Path: remote, Offset: int64(i), Size: size, RemoteSize: remoteSize}
+	} else if size != remoteSize {
+		return VerifyMismatchError{Path: remote, Offset: int64(n), Size: size, RemoteSize: remoteSize}
+	}
+	return nil
+}
+
+// binarySample every byte value, line endings and NULs, random bytes, then a
+// repeated pattern so compression is not skipped by the min ratio
+func binarySample() ([]byte, error) {
+	var b bytes.Buffer
+	for i := 0; i < 256; i++ {
+		b.WriteByte(byte(i))
+	}
+	b.WriteString("\r\n\n\r\x00\x00\r\n\x1a\xff\xfe")
+	random := make([]byte, 32*1024)
+	if _, err := rand.Read(random); err != nil {
+		return nil, err
+	}
+	b.Write(random)
+	for i := 0; i < 32*1024; i++ {
+		b.WriteByte(byte(i))
+	}
+	return b.Bytes(), nil
+}